@@ -4,6 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -12,23 +16,124 @@ import (
 // ConfigFile represents all the data read from a config file
 type ConfigFile map[string]*BuildStep
 
+// GlobalSection is the name of the reserved top-level entry in a pipeline
+// file that holds pipeline-wide vars and default step properties. It is
+// never treated as a build step.
+const GlobalSection = "_global"
+
 // BuildStep is a single step in a ConfigFile
 type BuildStep struct {
-	Name      string            // Set after parsing (not in config file)
-	Command   string            `yaml:"command"`
-	Inputs    []string          `yaml:"inputs"`
-	Outputs   []string          `yaml:"outputs"`
-	Clean     []string          `yaml:"clean"`
-	Explicit  bool              `yaml:"explicit"`
-	DelOnFail bool              `yaml:"delOnFail"`
-	Direct    bool              `yaml:"direct"`
-	Abstract  bool              `yaml:"abstract"`
-	BaseStep  string            `yaml:"baseStep"`
-	Vars      map[string]string `yaml:"vars"`
+	Name       string              // Set after parsing (not in config file)
+	Command    string              `yaml:"-"` // Set by UnmarshalYAML for a string command
+	Args       []string            `yaml:"-"` // Set by UnmarshalYAML for a list command
+	Inputs     []string            `yaml:"inputs"`
+	Outputs    []string            `yaml:"outputs"`
+	Clean      []string            `yaml:"clean"`
+	Explicit   bool                `yaml:"explicit"`
+	DelOnFail  bool                `yaml:"delOnFail"`
+	Direct     bool                `yaml:"direct"`
+	Abstract   bool                `yaml:"abstract"`
+	BaseStep   string              `yaml:"baseStep"`
+	Override   bool                `yaml:"overrideBase"`
+	Vars       map[string]string   `yaml:"vars"`
+	Matrix     map[string][]string `yaml:"matrix"`
+	Pattern    bool                `yaml:"pattern"`
+	DirInclude []string            `yaml:"dirInclude"`
+	DirExclude []string            `yaml:"dirExclude"`
+	DirHash    bool                `yaml:"dirHash"`
+	Needs      []string            `yaml:"needs"`
+	After      []string            `yaml:"after"`
+	Phony      bool                `yaml:"phony"`
+	Always     bool                `yaml:"always"`
+	Trace      bool                `yaml:"trace"`
+	Shell      Shell               `yaml:"shell"`
+	Workdir    string              `yaml:"workdir"`
+	Image      string              `yaml:"image"`
+	Runner     string              `yaml:"runner"`
+	Executor   string              `yaml:"executor"`
+	Host       string              `yaml:"host"`
+	RemoteDir  string              `yaml:"remoteDir"`
+	Resources  StepResources       `yaml:"resources"`
+	Env        StepEnv             `yaml:"env"`
+	Secrets    []string            `yaml:"secrets"`
+	Group      []string            `yaml:"group"`
+	Tags       []string            `yaml:"tags"`
+	Origin     string              `yaml:"-"` // Step this was generated from (not in config file)
+	Force      bool                `yaml:"-"` // Run regardless of the decider (see ForceSteps)
+	ancestors  []string            // Steps that generated Origin (like a matrix step for a pattern step)
+
+	given map[string]bool // Properties actually specified in the config file
+}
+
+// UnmarshalYAML parses a build step and remembers which properties were
+// actually specified, so that defaults only fill in what is missing
+func (step *BuildStep) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainStep BuildStep
+	if err := unmarshal((*plainStep)(step)); err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+	if err := unmarshal(&keys); err != nil {
+		return err
+	}
+
+	// The command may be a string (run by the shell) or a list (run directly)
+	var cmd struct {
+		Command stepCommand `yaml:"command"`
+	}
+	if err := unmarshal(&cmd); err != nil {
+		return err
+	}
+	step.Command, step.Args = cmd.Command.Text, cmd.Command.Args
+	if _, ok := keys["shell"]; ok && cmd.Command.Args != nil {
+		return fmt.Errorf("shell may not be given with a list command (it is run without a shell)")
+	}
+
+	step.given = make(map[string]bool, len(keys))
+	for k := range keys {
+		step.given[k] = true
+	}
+
+	return nil
+}
+
+// stepCommand is a step's command as given in the config file: a string or
+// a list of strings. Both are decoded as strings, so the text is kept exactly
+// as written (010 stays 010 and yes stays yes).
+type stepCommand struct {
+	Text string
+	Args []string
+}
+
+// UnmarshalYAML accepts a string or a list of strings
+func (sc *stepCommand) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&sc.Text); err == nil {
+		return nil
+	}
+	sc.Text = ""
+	if err := unmarshal(&sc.Args); err != nil {
+		return fmt.Errorf("command must be a string or a list of strings")
+	}
+	if sc.Args == nil {
+		sc.Args = []string{}
+	}
+	return nil
+}
+
+// isGiven returns true if the property was specified for the step
+func (step *BuildStep) isGiven(key string) bool {
+	return step.given[key]
 }
 
 // ReadConfig parses and returns the contents of the config file (or an error)
 func ReadConfig(fileContent []byte) (ConfigFile, error) {
+	return ReadConfigVars(fileContent, nil)
+}
+
+// ReadConfigVars is ReadConfig, but the given variables override (or are
+// added to) the vars of every step
+func ReadConfigVars(fileContent []byte, overrides map[string]string) (ConfigFile, error) {
 	// Parse the YAML
 	cfg := ConfigFile{}
 	err := yaml.Unmarshal(fileContent, cfg)
@@ -36,6 +141,11 @@ func ReadConfig(fileContent []byte) (ConfigFile, error) {
 		return nil, err
 	}
 
+	global, err := splitGlobal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg, abstractCfg, err := splitAbstractSteps(cfg)
 	if err != nil {
 		return nil, err
@@ -50,67 +160,112 @@ func ReadConfig(fileContent []byte) (ConfigFile, error) {
 		if step.Vars == nil {
 			step.Vars = make(map[string]string)
 		}
+		if step.given == nil {
+			step.given = make(map[string]bool)
+		}
+
+		// Groups only name other steps
+		if step.isGiven("group") {
+			if err := checkGroup(step); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
 		// Trim any whitespace from the command so they can use YAML multi-line
 		step.Command = strings.TrimSpace(step.Command)
 
+		// Pipeline-wide settings act as if the step gave them (unless it
+		// gave its own), so they come before anything from a base step
+		fromGlobal := applyGlobal(step, global)
+
 		// If this step has a base step, grab it's data
 		if len(step.BaseStep) > 0 {
-			abs, absok := abstractCfg[step.BaseStep]
-			if !absok {
-				return nil, errors.New("No abstract step named " + step.BaseStep)
+			abs, err := resolveAbstract(step.BaseStep, abstractCfg, map[string]bool{})
+			if err != nil {
+				return nil, err
 			}
+			inheritBase(step, abs, fromGlobal)
+		}
+	}
 
-			// ONLY copy command if we don't already have one
-			if len(step.Command) < 1 {
-				step.Command = abs.Command
-			}
+	// Steps with a matrix become one step per combination
+	cfg, err = expandMatrixSteps(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-			// Copy properties that override
-			step.Explicit = abs.Explicit
-			step.DelOnFail = abs.DelOnFail
-			step.Direct = abs.Direct
+	// Override vars (from the command line) always win
+	for _, step := range cfg {
+		for k, v := range overrides {
+			step.Vars[k] = v
+		}
+	}
 
-			// Append properties that just update
-			step.Inputs = append(step.Inputs, abs.Inputs...)
-			step.Outputs = append(step.Outputs, abs.Outputs...)
-			step.Clean = append(step.Clean, abs.Clean...)
+	// Steps with a pattern input become one step per matching file
+	cfg, err = expandPatternSteps(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-			// The Vars maps are different: the base map only supplies missing values
-			for k, v := range abs.Vars {
-				if _, ok := step.Vars[k]; !ok {
-					step.Vars[k] = v
-				}
-			}
-		}
+	// Groups and step-level dependencies may use the names of generated steps
+	if err := resolveGroups(cfg); err != nil {
+		return nil, err
+	}
+	if err := resolveStepDeps(cfg); err != nil {
+		return nil, err
+	}
 
+	for _, step := range cfg {
 		// Special: we add DMK_STEPNAME to the variables
 		step.Vars["DMK_STEPNAME"] = step.Name
 
-		// We allow globbing for inputs and clean
-		if i, e := MultiGlob(step.Inputs); e == nil {
-			step.Inputs = i
-		} else {
-			return nil, e
-		}
+		// We allow globbing for clean. Input globs are NOT globbed here: they
+		// are globbed when the step runs (after its dependencies finish)
 		if c, e := MultiGlob(step.Clean); e == nil {
 			step.Clean = c
 		} else {
 			return nil, e
 		}
 
+		if err := step.Shell.Check(); err != nil {
+			return nil, fmt.Errorf("%s: %v", step.Name, err)
+		}
+
 		// Expand any environment variables in command and input/clean/output
-		mapping := func(envKey string) string {
-			if val, ok := step.Vars[envKey]; ok {
-				return val
-			}
-			return os.Getenv(envKey)
+		mapping := varMapping(step)
+
+		step.Workdir = os.Expand(step.Workdir, mapping)
+		step.Image = os.Expand(step.Image, mapping)
+		step.Host = os.Expand(step.Host, mapping)
+		step.RemoteDir = os.Expand(step.RemoteDir, mapping)
+		step.Resources.Memory = os.Expand(step.Resources.Memory, mapping)
+		step.Resources.Time = os.Expand(step.Resources.Time, mapping)
+		step.Resources.Partition = os.Expand(step.Resources.Partition, mapping)
+		for i, opt := range step.Resources.Options {
+			step.Resources.Options[i] = os.Expand(opt, mapping)
+		}
+		if _, err := step.ContainerRunner(); err != nil {
+			return nil, fmt.Errorf("%s: %v", step.Name, err)
+		}
+		if _, err := step.LookupExecutor(); err != nil {
+			return nil, fmt.Errorf("%s: %v", step.Name, err)
+		}
+		for i, t := range step.Env.Files {
+			step.Env.Files[i] = os.Expand(t, mapping)
 		}
 
 		step.Command = os.Expand(step.Command, mapping)
-		for i, t := range step.Inputs {
-			step.Inputs[i] = os.Expand(t, mapping)
+		for i, arg := range step.Args {
+			step.Args[i] = os.Expand(arg, mapping)
+		}
+		inputs := NewUniqueStrings()
+		for _, t := range step.Inputs {
+			if len(strings.TrimSpace(t)) > 0 {
+				inputs.Add(os.Expand(t, mapping))
+			}
 		}
+		step.Inputs = inputs.Strings()
 		for i, t := range step.Outputs {
 			step.Outputs[i] = os.Expand(t, mapping)
 		}
@@ -122,62 +277,669 @@ func ReadConfig(fileContent []byte) (ConfigFile, error) {
 	return cfg, nil
 }
 
+// HasCommand returns true if the step has a command (of either form)
+func (step *BuildStep) HasCommand() bool {
+	return len(strings.TrimSpace(step.Command)) > 0 || len(step.Args) > 0
+}
+
+// CommandText returns the step's command for display. A list command is
+// shown with any argument that needs it quoted.
+func (step *BuildStep) CommandText() string {
+	if len(step.Args) < 1 {
+		return step.Command
+	}
+	quoted := make([]string, 0, len(step.Args))
+	for _, arg := range step.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`*?[]#;&|<>(){}~") {
+			arg = strconv.Quote(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// AlwaysRun marks every step so that it runs regardless of the decider (as
+// if it specified always=true)
+func AlwaysRun(cfg ConfigFile) {
+	for _, step := range cfg {
+		step.Always = true
+	}
+}
+
+// TraceAll marks every step so that its command is traced (as if it
+// specified trace=true)
+func TraceAll(cfg ConfigFile) {
+	for _, step := range cfg {
+		step.Trace = true
+	}
+}
+
+// HasTag returns true if the step has the given tag
+func (step *BuildStep) HasTag(tag string) bool {
+	for _, t := range step.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsGroup returns true if the step is a group of other steps. Groups are never
+// executed: they are just a way to name a set of steps.
+func (step *BuildStep) IsGroup() bool {
+	return len(step.Group) > 0
+}
+
+// checkGroup makes sure a group doesn't specify anything but its steps
+func checkGroup(step *BuildStep) error {
+	if len(step.Group) < 1 {
+		return fmt.Errorf("%s: group has no steps", step.Name)
+	}
+	for key := range step.given {
+		if key != "group" {
+			return fmt.Errorf("%s: a group may not specify %s", step.Name, key)
+		}
+	}
+	return nil
+}
+
+// resolveGroups replaces the list for every group with the names of the steps
+// it selects. A group may list anything ResolveStepNames accepts.
+func resolveGroups(cfg ConfigFile) error {
+	done := make(map[string]bool)
+	visiting := make(map[string]bool)
+
+	var resolve func(group *BuildStep) error
+	resolve = func(group *BuildStep) error {
+		if done[group.Name] {
+			return nil
+		}
+		if visiting[group.Name] {
+			return fmt.Errorf("group loop found at %s", group.Name)
+		}
+		visiting[group.Name] = true
+
+		found := NewUniqueStrings()
+		for _, member := range group.Group {
+			if sub, ok := cfg[member]; ok && sub.IsGroup() {
+				if err := resolve(sub); err != nil {
+					return err
+				}
+				for _, name := range sub.Group {
+					found.Add(name)
+				}
+				continue
+			}
+
+			names, err := ResolveStepNames(cfg, []string{member})
+			if err != nil {
+				return fmt.Errorf("%s: group %v", group.Name, err)
+			}
+			for _, name := range names {
+				found.Add(name)
+			}
+		}
+		group.Group = found.Strings()
+
+		delete(visiting, group.Name)
+		done[group.Name] = true
+		return nil
+	}
+
+	for _, step := range cfg {
+		if step.IsGroup() {
+			if err := resolve(step); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StepDeps returns the names of all steps this step depends on directly (via
+// needs or after instead of via inputs and outputs)
+func (step *BuildStep) StepDeps() []string {
+	deps := make([]string, 0, len(step.Needs)+len(step.After))
+	deps = append(deps, step.Needs...)
+	return append(deps, step.After...)
+}
+
+// resolveStepDeps replaces the names in every step's needs and after lists
+// with the actual step names (see ResolveStepNames) and checks for problems:
+// steps depending on themselves, loops, and phony steps with outputs
+func resolveStepDeps(cfg ConfigFile) error {
+	for _, step := range cfg {
+		if step.Phony && len(step.Outputs) > 0 {
+			return fmt.Errorf("%s: a phony step may not have outputs", step.Name)
+		}
+
+		var err error
+		if step.Needs, err = ResolveStepNames(cfg, step.Needs); err != nil {
+			return fmt.Errorf("%s: needs %v", step.Name, err)
+		}
+		if step.After, err = ResolveStepNames(cfg, step.After); err != nil {
+			return fmt.Errorf("%s: after %v", step.Name, err)
+		}
+	}
+
+	// Look for loops with a depth-first search
+	done := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("needs/after loop found at step %s", name)
+		}
+		visiting[name] = true
+		for _, dep := range cfg[name].StepDeps() {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		delete(visiting, name)
+		done[name] = true
+		return nil
+	}
+	for name := range cfg {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Prefixes for variable names that are really a file name, giving the file's
+// absolute path (like ${abs:data.csv}) or its path relative to the step's
+// working directory (like ${rel:data.csv})
+const (
+	AbsPathPrefix = "abs:"
+	RelPathPrefix = "rel:"
+)
+
+// varMapping returns the function used with os.Expand for the step's
+// variables: step vars first, then file paths, then the environment
+func varMapping(step *BuildStep) func(string) string {
+	return func(envKey string) string {
+		if val, ok := step.Vars[envKey]; ok {
+			return val
+		}
+		if strings.HasPrefix(envKey, AbsPathPrefix) {
+			file := strings.TrimPrefix(envKey, AbsPathPrefix)
+			if abs, err := filepath.Abs(file); err == nil {
+				return abs
+			}
+			return file
+		}
+		if strings.HasPrefix(envKey, RelPathPrefix) {
+			return step.WorkdirPath(strings.TrimPrefix(envKey, RelPathPrefix))
+		}
+		return os.Getenv(envKey)
+	}
+}
+
+// WorkdirPath returns the path for the file (relative to the pipeline
+// directory) from the step's working directory
+func (step *BuildStep) WorkdirPath(file string) string {
+	if len(step.Workdir) < 1 || filepath.IsAbs(file) {
+		return file
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return file
+	}
+	dir, err := filepath.Abs(step.Workdir)
+	if err != nil {
+		return abs
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil {
+		return abs
+	}
+	return rel
+}
+
+// WorkdirPaths is WorkdirPath for every file
+func (step *BuildStep) WorkdirPaths(files []string) []string {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, step.WorkdirPath(file))
+	}
+	return paths
+}
+
+// Produces returns true if a step with the given output satisfies the given
+// input of another step. Besides matching exactly, an output glob produces
+// any input it matches, an input glob is produced by any output it matches,
+// and an output directory (ending with a "/") produces anything inside it.
+func Produces(output string, input string) bool {
+	if output == input {
+		return true
+	}
+	if IsGlob(input) {
+		if matched, err := filepath.Match(input, output); err == nil && matched {
+			return true
+		}
+	}
+	if IsGlob(output) {
+		if matched, err := filepath.Match(output, input); err == nil && matched {
+			return true
+		}
+	}
+	if IsDirPath(output) {
+		dir := filepath.Clean(output)
+		cleanInput := filepath.Clean(input)
+		if cleanInput == dir || strings.HasPrefix(cleanInput, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// StepSelector describes the steps to run. Names may be anything
+// ResolveStepNames accepts, Tags selects every step with one of the tags,
+// From selects the named steps and every step downstream of them, and the
+// Exclude steps are skipped along with any dependencies only they need. If
+// there are no Names, Tags or From steps, every step without explicit=true is
+// selected. If NoDeps is true, then dependencies aren't added.
+type StepSelector struct {
+	Names   []string
+	Tags    []string
+	From    []string
+	Exclude []string
+	NoDeps  bool
+}
+
+// IsEmpty returns true if the selector doesn't change the default selection
+func (sel StepSelector) IsEmpty() bool {
+	return len(sel.Names)+len(sel.Tags)+len(sel.From)+len(sel.Exclude) < 1 && !sel.NoDeps
+}
+
 // TrimSteps removes all steps except the ones given and their dependencies
 // via a copy-and-return (the config file passed in is unchanged)
 func TrimSteps(cfg ConfigFile, reqStepNames []string) (ConfigFile, error) {
-	// Find our initial steps and their dependencies
-	reqSteps := make(map[string]bool)
-	reqDeps := make(map[string]bool)
+	if len(reqStepNames) < 1 {
+		return ConfigFile{}, nil // Nothing asked for, nothing kept
+	}
+	return SelectSteps(cfg, StepSelector{Names: reqStepNames})
+}
 
-	for _, s := range reqStepNames {
-		if _, inMap := cfg[s]; !inMap {
-			return nil, fmt.Errorf("%s is not in the pipeline file", s)
+// SelectSteps removes all steps except the ones selected and their
+// dependencies via a copy-and-return (the config file passed in is unchanged)
+func SelectSteps(cfg ConfigFile, sel StepSelector) (ConfigFile, error) {
+	excludeNames, err := ResolveStepNames(cfg, sel.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make(map[string]bool)
+	for _, name := range excludeNames {
+		exclude[name] = true
+	}
+
+	// Find our initial steps
+	names, err := ResolveStepNames(cfg, sel.Names)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range sel.Tags {
+		tagged := 0
+		for name, step := range cfg {
+			if step.HasTag(tag) {
+				names = append(names, name)
+				tagged++
+			}
 		}
-		reqSteps[s] = true
-		for _, dep := range cfg[s].Inputs {
-			reqDeps[dep] = true
+		if tagged < 1 {
+			return nil, fmt.Errorf("No steps are tagged %s", tag)
 		}
 	}
 
-	// Keeping adding steps our deps require until we can't add no more
-	foundCount := len(reqSteps)
-	for {
-		// Add new deps
+	if len(sel.From) > 0 {
+		fromNames, err := ResolveStepNames(cfg, sel.From)
+		if err != nil {
+			return nil, err
+		}
+		for name := range dependentClosure(cfg, fromNames) {
+			names = append(names, name)
+		}
+	}
+
+	if len(sel.Names)+len(sel.Tags)+len(sel.From) < 1 {
+		// Everything by default, except for explicit steps and steps only
+		// selected because an excluded step needs them
+		upstream := dependencyClosure(cfg, excludeNames, nil)
 		for name, step := range cfg {
-			if _, inMap := reqSteps[name]; inMap {
-				continue // already seen this one
-			}
-			for _, dep := range step.Outputs {
-				if _, inMap := reqDeps[dep]; inMap {
-					reqSteps[name] = true // New dependency
-					for _, prevDep := range step.Inputs {
-						reqDeps[prevDep] = true // Get anythiung the new dep needs
-					}
-				}
+			if !step.Explicit && !step.IsGroup() && !upstream[name] {
+				names = append(names, name)
 			}
 		}
+	}
 
-		if len(reqSteps) <= foundCount {
-			break // Nothing found in our iteration
+	var keep map[string]bool
+	if sel.NoDeps {
+		keep = make(map[string]bool)
+		for _, name := range names {
+			if !exclude[name] {
+				keep[name] = true
+			}
 		}
-		foundCount = len(reqSteps)
+	} else {
+		keep = dependencyClosure(cfg, names, exclude)
 	}
 
 	// Now copy only the steps to keep
 	newCfg := ConfigFile{}
-	for name := range reqSteps {
+	for name := range keep {
 		newCfg[name] = cfg[name]
 	}
 
 	return newCfg, nil
 }
 
+// UpstreamSteps returns the names of the steps the given step depends on
+// directly: steps producing one of its inputs, and steps it needs or runs
+// after
+func UpstreamSteps(cfg ConfigFile, step *BuildStep) []string {
+	found := NewUniqueStrings()
+	for _, name := range step.StepDeps() {
+		found.Add(name)
+	}
+	for _, name := range producerSteps(cfg, step) {
+		found.Add(name)
+	}
+	return found.Strings()
+}
+
+// producerSteps returns the names of the steps producing one of the given
+// step's inputs
+func producerSteps(cfg ConfigFile, step *BuildStep) []string {
+	found := []string{}
+	for name, other := range cfg {
+		if name == step.Name {
+			continue
+		}
+	outputs:
+		for _, out := range other.Outputs {
+			for _, in := range step.Inputs {
+				if Produces(out, in) {
+					found = append(found, name)
+					break outputs
+				}
+			}
+		}
+	}
+	return found
+}
+
+// dependentIndex maps each step name to the steps that must run again when it
+// does: steps using one of its outputs and steps that need it. Steps that only
+// run after it aren't included since after never causes a step to run.
+func dependentIndex(cfg ConfigFile) map[string]*UniqueStrings {
+	index := make(map[string]*UniqueStrings)
+	add := func(up string, down string) {
+		if _, ok := index[up]; !ok {
+			index[up] = NewUniqueStrings()
+		}
+		index[up].Add(down)
+	}
+	for name, step := range cfg {
+		if step.IsGroup() {
+			continue
+		}
+		for _, up := range step.Needs {
+			add(up, name)
+		}
+		for _, up := range producerSteps(cfg, step) {
+			add(up, name)
+		}
+	}
+	return index
+}
+
+// DownstreamSteps returns the names of the steps that depend directly on the
+// given step's outputs or need it (see dependentIndex)
+func DownstreamSteps(cfg ConfigFile, step *BuildStep) []string {
+	if down, ok := dependentIndex(cfg)[step.Name]; ok {
+		return down.Strings()
+	}
+	return []string{}
+}
+
+// dependentClosure returns the named steps and every step downstream of them
+func dependentClosure(cfg ConfigFile, names []string) map[string]bool {
+	index := dependentIndex(cfg)
+	found := make(map[string]bool)
+	queue := make([]string, 0, len(names))
+	for _, name := range names {
+		if !found[name] {
+			found[name] = true
+			queue = append(queue, name)
+		}
+	}
+
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		down, ok := index[name]
+		if !ok {
+			continue
+		}
+		for dep := range down.Seen {
+			if !found[dep] {
+				found[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	return found
+}
+
+// ForceSteps marks the named steps and every step downstream of them so that
+// they run regardless of the decider. The steps selected to run aren't
+// changed. The names of all the forced steps are returned.
+func ForceSteps(cfg ConfigFile, reqStepNames []string) ([]string, error) {
+	names, err := ResolveStepNames(cfg, reqStepNames)
+	if err != nil {
+		return nil, err
+	}
+
+	forced := NewUniqueStrings()
+	for name := range dependentClosure(cfg, names) {
+		cfg[name].Force = true
+		forced.Add(name)
+	}
+	return forced.Strings(), nil
+}
+
+// TopoSort returns the names of the steps (but not groups) ordered so that
+// every step comes after the steps it depends on. Dependencies on steps that
+// aren't in the config file are ignored.
+func TopoSort(cfg ConfigFile) ([]string, error) {
+	remaining := make(map[string][]string)
+	for name, step := range cfg {
+		if step.IsGroup() {
+			continue
+		}
+		deps := []string{}
+		for _, dep := range UpstreamSteps(cfg, step) {
+			if _, ok := cfg[dep]; ok {
+				deps = append(deps, dep)
+			}
+		}
+		remaining[name] = deps
+	}
+
+	done := make(map[string]bool)
+	order := make([]string, 0, len(remaining))
+	for len(remaining) > 0 {
+		ready := []string{}
+		for name, deps := range remaining {
+			waiting := false
+			for _, dep := range deps {
+				if !done[dep] {
+					waiting = true
+					break
+				}
+			}
+			if !waiting {
+				ready = append(ready, name)
+			}
+		}
+		if len(ready) < 1 {
+			stuck := make([]string, 0, len(remaining))
+			for name := range remaining {
+				stuck = append(stuck, name)
+			}
+			sort.Strings(stuck)
+			return nil, fmt.Errorf("Dependency loop found in %d steps: %s", len(remaining), strings.Join(stuck, ", "))
+		}
+
+		sort.Strings(ready)
+		for _, name := range ready {
+			done[name] = true
+			delete(remaining, name)
+		}
+		order = append(order, ready...)
+	}
+
+	return order, nil
+}
+
+// dependencyClosure returns the named steps and everything they depend on.
+// Steps in skip are never added (and so their dependencies are only added if
+// something else needs them).
+func dependencyClosure(cfg ConfigFile, names []string, skip map[string]bool) map[string]bool {
+	found := make(map[string]bool)
+	queue := make([]string, 0, len(names))
+	for _, name := range names {
+		if !skip[name] && !found[name] {
+			found[name] = true
+			queue = append(queue, name)
+		}
+	}
+
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, dep := range UpstreamSteps(cfg, cfg[name]) {
+			if !skip[dep] && !found[dep] {
+				found[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	return found
+}
+
+// ResolveStepNames returns the names of the steps requested. A requested
+// name may be:
+//   - a step name
+//   - the name of a step that was expanded into several steps (e.g. via a
+//     matrix), meaning all the generated steps
+//   - the name of a group, meaning the group's steps
+//   - a glob pattern (like report_*) or a regular expression starting with ~
+//     (like ~^report_), meaning all matching steps that aren't groups
+func ResolveStepNames(cfg ConfigFile, reqStepNames []string) ([]string, error) {
+	found := NewUniqueStrings()
+
+	for _, s := range reqStepNames {
+		if step, inMap := cfg[s]; inMap {
+			if step.IsGroup() {
+				for _, name := range step.Group {
+					found.Add(name)
+				}
+			} else {
+				found.Add(s)
+			}
+			continue
+		}
+
+		if IsGlob(s) || strings.HasPrefix(s, StepRegexPrefix) {
+			matched, err := matchStepNames(cfg, s)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range matched {
+				found.Add(name)
+			}
+			continue
+		}
+
+		generated := 0
+		for name, step := range cfg {
+			if step.GeneratedFrom(s) {
+				found.Add(name)
+				generated++
+			}
+		}
+		if generated < 1 {
+			return nil, fmt.Errorf("%s is not in the pipeline file", s)
+		}
+	}
+
+	return found.Strings(), nil
+}
+
+// GeneratedFrom returns true if the step was generated from the named step:
+// either directly (the Origin) or by generating the Origin
+func (step *BuildStep) GeneratedFrom(name string) bool {
+	if step.Origin == name {
+		return true
+	}
+	for _, a := range step.ancestors {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// StepRegexPrefix starts a step name that is really a regular expression
+const StepRegexPrefix = "~"
+
+// matchStepNames returns the steps (but not groups) matching the glob pattern
+// or regular expression. It is an error if nothing matches.
+func matchStepNames(cfg ConfigFile, pattern string) ([]string, error) {
+	var match func(string) bool
+	if strings.HasPrefix(pattern, StepRegexPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, StepRegexPrefix))
+		if err != nil {
+			return nil, err
+		}
+		match = re.MatchString
+	} else {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: %v", pattern, err)
+		}
+		match = func(name string) bool {
+			ok, _ := filepath.Match(pattern, name)
+			return ok
+		}
+	}
+
+	found := NewUniqueStrings()
+	for name, step := range cfg {
+		if !step.IsGroup() && match(name) {
+			found.Add(name)
+		}
+	}
+	if len(found.Seen) < 1 {
+		return nil, fmt.Errorf("%s matches no steps", pattern)
+	}
+	return found.Strings(), nil
+}
+
 // NoExplicit returns a copy of the config file with all explicit=true steps
-// removed.
+// (and all groups) removed.
 func NoExplicit(cfg ConfigFile) (ConfigFile, error) {
 	newCfg := ConfigFile{}
 	for name, step := range cfg {
-		if !step.Explicit {
+		if !step.Explicit && !step.IsGroup() {
 			newCfg[name] = cfg[name]
 		}
 	}
@@ -185,6 +947,206 @@ func NoExplicit(cfg ConfigFile) (ConfigFile, error) {
 	return newCfg, nil
 }
 
+// resolveAbstract returns the named abstract step after merging in its own
+// chain of base steps. Abstract steps are only resolved once (resolved steps
+// have their BaseStep cleared) and visiting tracks the current chain so that
+// cycles are reported instead of recursing forever.
+func resolveAbstract(name string, abstractCfg ConfigFile, visiting map[string]bool) (*BuildStep, error) {
+	abs, absok := abstractCfg[name]
+	if !absok {
+		return nil, errors.New("No abstract step named " + name)
+	}
+	if len(abs.BaseStep) < 1 {
+		return abs, nil // Nothing to resolve (or already resolved)
+	}
+	if visiting[name] {
+		return nil, fmt.Errorf("baseStep cycle found at abstract step %s", name)
+	}
+	visiting[name] = true
+
+	base, err := resolveAbstract(abs.BaseStep, abstractCfg, visiting)
+	if err != nil {
+		return nil, err
+	}
+	inheritBase(abs, base, nil)
+	abs.BaseStep = ""
+
+	return abs, nil
+}
+
+// inheritBase merges the (fully resolved) base step into the step:
+//
+//   - The command is only copied if the step doesn't have one
+//   - explicit, delOnFail, and direct are copied from the base, unless the
+//     step sets overrideBase: then only values the step didn't give are copied.
+//     Properties in keep (the ones from the global section) are never copied.
+//   - inputs, outputs, and clean are appended to the step's lists
+//   - vars from the base only supply missing values
+func inheritBase(step *BuildStep, base *BuildStep, keep map[string]bool) {
+	if step.Vars == nil {
+		step.Vars = make(map[string]string)
+	}
+	if step.given == nil {
+		step.given = make(map[string]bool)
+	}
+
+	// ONLY copy command if we don't already have one
+	if !step.HasCommand() {
+		step.Command = strings.TrimSpace(base.Command)
+		step.Args = append([]string(nil), base.Args...)
+	}
+
+	// Copy properties that override
+	if !keep["explicit"] && (!step.Override || !step.isGiven("explicit")) {
+		step.Explicit = base.Explicit
+	}
+	if !keep["delOnFail"] && (!step.Override || !step.isGiven("delOnFail")) {
+		step.DelOnFail = base.DelOnFail
+	}
+	if !keep["direct"] && (!step.Override || !step.isGiven("direct")) {
+		step.Direct = base.Direct
+	}
+
+	// Append properties that just update
+	step.Inputs = append(step.Inputs, base.Inputs...)
+	step.Outputs = append(step.Outputs, base.Outputs...)
+	step.Clean = append(step.Clean, base.Clean...)
+
+	// The Vars maps are different: the base map only supplies missing values
+	for k, v := range base.Vars {
+		if _, ok := step.Vars[k]; !ok {
+			step.Vars[k] = v
+		}
+	}
+
+	mergeOptions(step, base)
+
+	// Anything the base step specified counts as specified for defaults
+	for k := range base.given {
+		step.given[k] = true
+	}
+}
+
+// globalExcluded are the properties the global section may not give: they
+// only make sense for a single step
+var globalExcluded = []string{
+	"abstract", "baseStep", "matrix", "pattern", "group", "needs", "after",
+	"inputs", "outputs", "clean",
+}
+
+// splitGlobal removes the reserved global section from the config file and
+// returns it. If there is no global section, an empty step is returned.
+func splitGlobal(cfg ConfigFile) (*BuildStep, error) {
+	global, found := cfg[GlobalSection]
+	delete(cfg, GlobalSection)
+	if !found || global == nil {
+		return &BuildStep{given: map[string]bool{}}, nil
+	}
+
+	for _, key := range globalExcluded {
+		if global.isGiven(key) {
+			return nil, fmt.Errorf("%s may not specify %s (allowed for steps only)", GlobalSection, key)
+		}
+	}
+
+	return global, nil
+}
+
+// applyGlobal fills in any properties the step did not specify from the
+// global section, as if the step had specified them: so global values are
+// used before any from the step's base step. Global vars only supply values
+// the step doesn't have. The properties supplied are returned.
+func applyGlobal(step *BuildStep, global *BuildStep) map[string]bool {
+	supplied := make(map[string]bool)
+	for k := range global.given {
+		if !step.isGiven(k) {
+			supplied[k] = true
+		}
+	}
+
+	if !step.HasCommand() {
+		step.Command = strings.TrimSpace(global.Command)
+		step.Args = append([]string(nil), global.Args...)
+	}
+
+	if !step.isGiven("explicit") {
+		step.Explicit = global.Explicit
+	}
+	if !step.isGiven("delOnFail") {
+		step.DelOnFail = global.DelOnFail
+	}
+	if !step.isGiven("direct") {
+		step.Direct = global.Direct
+	}
+
+	for k, v := range global.Vars {
+		if _, ok := step.Vars[k]; !ok {
+			step.Vars[k] = v
+		}
+	}
+
+	mergeOptions(step, global)
+
+	// Anything the global section specified now counts as specified by the
+	// step, so a base step doesn't replace it
+	for k := range supplied {
+		step.given[k] = true
+	}
+	return supplied
+}
+
+// mergeOptions fills in the step's optional properties from a base step or
+// the global section: lists are appended and everything else is only copied
+// if the step didn't give it
+func mergeOptions(step *BuildStep, from *BuildStep) {
+	step.DirInclude = append(step.DirInclude, from.DirInclude...)
+	step.DirExclude = append(step.DirExclude, from.DirExclude...)
+
+	step.Needs = append(step.Needs, from.Needs...)
+	step.After = append(step.After, from.After...)
+	step.Tags = append(step.Tags, from.Tags...)
+	step.Secrets = append(step.Secrets, from.Secrets...)
+
+	if !step.isGiven("dirHash") {
+		step.DirHash = from.DirHash
+	}
+	if !step.isGiven("phony") {
+		step.Phony = from.Phony
+	}
+	if !step.isGiven("pattern") {
+		step.Pattern = from.Pattern
+	}
+	if !step.isGiven("always") {
+		step.Always = from.Always
+	}
+	if !step.isGiven("trace") {
+		step.Trace = from.Trace
+	}
+	if !step.isGiven("shell") {
+		step.Shell = append(Shell(nil), from.Shell...)
+	}
+	if !step.isGiven("workdir") {
+		step.Workdir = from.Workdir
+	}
+	if !step.isGiven("image") {
+		step.Image = from.Image
+	}
+	if !step.isGiven("runner") {
+		step.Runner = from.Runner
+	}
+	if !step.isGiven("executor") {
+		step.Executor = from.Executor
+	}
+	if !step.isGiven("host") {
+		step.Host = from.Host
+	}
+	if !step.isGiven("remoteDir") {
+		step.RemoteDir = from.RemoteDir
+	}
+	step.Env.merge(from.Env)
+	step.Resources.merge(from.Resources)
+}
+
 // splitAbstractSteps returns two config files: the main config with all
 // abstract steps removed and another with only the abstract steps
 func splitAbstractSteps(cfg ConfigFile) (norm ConfigFile, abstract ConfigFile, err error) {
@@ -2,6 +2,9 @@ package main
 
 import (
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -198,3 +201,677 @@ func TestAbstractSteps(t *testing.T) {
 	assert.Equal(step.Outputs, []string{"base-extra-output.txt", "base-output.txt"})
 	assert.Equal(step.Clean, []string{"base-extra-clean.txt", "extra.txt"})
 }
+
+func TestGlobalSection(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/global.yaml")
+	pcheck(err)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Len(cfg, 3) // 3 = 5 - 1 abstract - 1 global
+	assert.NotContains(cfg, GlobalSection)
+
+	var step *BuildStep
+
+	// Global vars and defaults fill in everything
+	step = cfg["use_global"]
+	assert.NotNil(step)
+	assert.Equal("echo global val 1 global val 2", step.Command)
+	assert.Equal([]string{"data/in.txt"}, step.Inputs)
+	assert.Equal([]string{"data/out.txt"}, step.Outputs)
+	assert.True(step.DelOnFail)
+	assert.True(step.Direct)
+	assert.False(step.Explicit)
+
+	// Global vars and properties win over the base step, which fills in the
+	// rest
+	step = cfg["use_base"]
+	assert.NotNil(step)
+	assert.Equal("echo global val 1 global val 2 step val 3 base val 4", step.Command)
+	assert.True(step.DelOnFail)
+	assert.True(step.Direct)
+	assert.True(step.Always)
+
+	// Step vars and properties win over everything
+	step = cfg["override"]
+	assert.NotNil(step)
+	assert.Equal("echo step val 1", step.Command)
+	assert.False(step.DelOnFail)
+	assert.True(step.Direct)
+
+	// Global section can't be a base step, or give anything that only makes
+	// sense for a single step
+	for _, key := range globalExcluded {
+		text := "_global:\n    " + key + ": []\na:\n    command: x\n"
+		switch key {
+		case "abstract", "pattern":
+			text = "_global:\n    " + key + ": true\n"
+		case "baseStep":
+			text = "_global:\n    baseStep: a\na:\n    command: x\n"
+		case "matrix":
+			text = "_global:\n    matrix: {n: [1, 2]}\na:\n    command: x\n"
+		}
+		_, err = ReadConfig([]byte(text))
+		if assert.Error(err, key) {
+			assert.Contains(err.Error(), "_global may not specify "+key)
+		}
+	}
+}
+
+func TestOverrideVars(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/global.yaml")
+	pcheck(err)
+	cfg, err := ReadConfigVars(cfgText, map[string]string{
+		"var1":     "cmd val 1",
+		"DATA_DIR": "other",
+		"NEW_VAR":  "injected",
+	})
+	pcheck(err)
+	assert.Len(cfg, 3)
+
+	step := cfg["use_global"]
+	assert.Equal("echo cmd val 1 global val 2", step.Command)
+	assert.Equal([]string{"other/in.txt"}, step.Inputs)
+	assert.Equal([]string{"other/out.txt"}, step.Outputs)
+
+	// Step vars lose to overrides
+	step = cfg["override"]
+	assert.Equal("echo cmd val 1", step.Command)
+
+	// Every step gets the new variable
+	for _, step := range cfg {
+		assert.Equal("injected", step.Vars["NEW_VAR"])
+	}
+}
+
+func TestBaseStepChains(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/chain.yaml")
+	pcheck(err)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Len(cfg, 2) // 2 = 4 - 2 abstract
+
+	var step *BuildStep
+
+	// Everything is inherited through the whole chain
+	step = cfg["train_xgb"]
+	assert.NotNil(step)
+	assert.Equal("train_base", step.BaseStep)
+	assert.Equal("python3 train.py", step.Command)
+	assert.True(step.Explicit)
+	assert.True(step.DelOnFail)
+	assert.True(step.Direct)
+	assert.Equal([]string{"requirements.txt", "train.csv", "xgb.py"}, step.Inputs)
+	assert.Equal([]string{"xgb.model"}, step.Outputs)
+	assert.Equal("42", step.Vars["SEED"])
+	assert.Equal("train.py", step.Vars["SCRIPT"])
+
+	// Only the given values override the base
+	step = cfg["train_quiet"]
+	assert.NotNil(step)
+	assert.True(step.Explicit)
+	assert.True(step.DelOnFail)
+	assert.False(step.Direct)
+	assert.Equal("1", step.Vars["SEED"])
+
+	// Cycles (including to self) are errors
+	_, err = ReadConfig([]byte(`
+a: {abstract: true, baseStep: b}
+b: {abstract: true, baseStep: c}
+c: {abstract: true, baseStep: a}
+d: {baseStep: a, outputs: [d.txt]}
+`))
+	assert.Error(err)
+
+	_, err = ReadConfig([]byte(`
+a: {abstract: true, baseStep: a}
+d: {baseStep: a, outputs: [d.txt]}
+`))
+	assert.Error(err)
+
+	// Missing base steps anywhere in the chain are errors
+	_, err = ReadConfig([]byte(`
+a: {abstract: true, baseStep: missing}
+d: {baseStep: a, outputs: [d.txt]}
+`))
+	assert.Error(err)
+}
+
+func TestDirectoryOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := ReadConfig([]byte(`
+_global:
+    dirExclude: [__pycache__]
+    dirHash: true
+base:
+    abstract: true
+    dirInclude: ["*.py"]
+uses_all:
+    baseStep: base
+    inputs: [src/]
+    outputs: [a.txt]
+    dirExclude: ["*.pyc"]
+no_hash:
+    inputs: [src/]
+    outputs: [b.txt]
+    dirHash: false
+`))
+	pcheck(err)
+
+	step := cfg["uses_all"]
+	assert.Equal([]string{"*.py"}, step.DirInclude)
+	assert.Equal([]string{"*.pyc", "__pycache__"}, step.DirExclude)
+	assert.True(step.DirHash)
+
+	step = cfg["no_hash"]
+	assert.Len(step.DirInclude, 0)
+	assert.Equal([]string{"__pycache__"}, step.DirExclude)
+	assert.False(step.DirHash)
+}
+
+func TestStepDepsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/ordering.yaml")
+	pcheck(err)
+
+	cfg, err := ReadConfig(cfgText)
+	assert.NoError(err)
+	assert.Len(cfg, 5)
+	assert.Equal([]string{"setup"}, cfg["load"].StepDeps())
+	assert.Equal([]string{"load", "migrate"}, cfg["everything"].StepDeps())
+	assert.True(cfg["setup"].Phony)
+
+	// Trimming follows needs and after
+	assertSteps(assert, cfg, []string{"load"}, "load", "setup")
+	assertSteps(assert, cfg, []string{"everything"}, "everything", "load", "migrate", "schema", "setup")
+
+	// Generated steps can be needed by their original name
+	cfg, err = ReadConfig([]byte(`
+train:
+    command: "touch $DS.out"
+    matrix: {DS: [a, b]}
+    outputs: [$DS.out]
+report:
+    command: echo done
+    phony: true
+    needs: [train]
+`))
+	assert.NoError(err)
+	assert.Equal([]string{"train.a", "train.b"}, cfg["report"].Needs)
+
+	// Things that can't work
+	_, err = ReadConfig([]byte("a:\n    command: x\n    outputs: [a.txt]\n    needs: [nope]\n"))
+	assert.Error(err)
+	_, err = ReadConfig([]byte("a:\n    command: x\n    outputs: [a.txt]\n    phony: true\n"))
+	assert.Error(err)
+	_, err = ReadConfig([]byte("a:\n    command: x\n    outputs: [a.txt]\n    after: [a]\n"))
+	assert.Error(err)
+	_, err = ReadConfig([]byte(`
+a:
+    command: x
+    outputs: [a.txt]
+    needs: [b]
+b:
+    command: x
+    outputs: [b.txt]
+    after: [a]
+`))
+	assert.Error(err)
+}
+
+func TestGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/groups.yaml")
+	pcheck(err)
+
+	cfg, err := ReadConfig(cfgText)
+	assert.NoError(err)
+	assert.Len(cfg, 7)
+	assert.True(cfg["all-reports"].IsGroup())
+	assert.Equal([]string{"report_costs", "report_sales"}, cfg["all-reports"].Group)
+	assert.Equal([]string{"plot.png", "plot.svg", "report_costs", "report_sales", "summary"}, cfg["everything"].Group)
+
+	// Groups select their steps (and dependencies) but are never selected
+	assertSteps(assert, cfg, []string{"all-reports"}, "report_costs", "report_sales")
+	assertSteps(assert, cfg, []string{"everything"}, "plot.png", "plot.svg", "report_costs", "report_sales", "summary")
+
+	noExp, err := NoExplicit(cfg)
+	assert.NoError(err)
+	assert.Len(noExp, 5)
+
+	// Groups can be needed
+	cfg, err = ReadConfig([]byte(`
+a:
+    command: "touch a"
+    outputs: [a]
+g:
+    group: [a]
+b:
+    command: "touch b"
+    outputs: [b]
+    needs: [g]
+`))
+	assert.NoError(err)
+	assert.Equal([]string{"a"}, cfg["b"].Needs)
+
+	// Problems
+	bad := []string{
+		"g:\n    group: [nope]\n",
+		"g:\n    group: [nope*]\n",
+		"g:\n    group: []\n",
+		"g:\n    group: [h]\nh:\n    group: [g]\n",
+		"a:\n    command: x\n    outputs: [a]\ng:\n    group: [a]\n    command: x\n",
+	}
+	for _, text := range bad {
+		_, err = ReadConfig([]byte(text))
+		assert.Error(err, text)
+	}
+}
+
+func TestSelectSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/select.yaml")
+	pcheck(err)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+
+	assertSelect := func(sel StepSelector, expected ...string) {
+		newCfg, err := SelectSteps(cfg, sel)
+		assert.NoError(err)
+		names := make([]string, 0, len(newCfg))
+		for name := range newCfg {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		assert.Equal(expected, names, "%+v", sel)
+	}
+
+	assert.Equal([]string{"features"}, UpstreamSteps(cfg, cfg["train_a"]))
+	assert.Equal([]string{"train_a", "train_b"}, UpstreamSteps(cfg, cfg["report"]))
+
+	// Default is everything but explicit steps
+	assertSelect(StepSelector{}, "docs", "features", "raw", "report", "train_a", "train_b")
+
+	// Patterns and tags
+	assertSelect(StepSelector{Names: []string{"train_*"}}, "features", "raw", "train_a", "train_b")
+	assertSelect(StepSelector{Names: []string{"~_a$"}}, "features", "raw", "train_a")
+	assertSelect(StepSelector{Tags: []string{"nightly"}}, "features", "raw", "train_a")
+	assertSelect(StepSelector{Names: []string{"lint"}, Tags: []string{"models"}}, "features", "lint", "raw", "train_a", "train_b")
+
+	// Excluded steps and the dependencies only they need
+	assertSelect(StepSelector{Names: []string{"report"}, Exclude: []string{"train_b"}}, "features", "raw", "report", "train_a")
+	assertSelect(StepSelector{Names: []string{"report"}, Exclude: []string{"features"}}, "report", "train_a", "train_b")
+	assertSelect(StepSelector{Exclude: []string{"report"}}, "docs")
+	assertSelect(StepSelector{Exclude: []string{"train_*"}}, "docs", "report")
+
+	// No dependencies
+	assertSelect(StepSelector{Names: []string{"report"}, NoDeps: true}, "report")
+	assertSelect(StepSelector{Tags: []string{"models"}, Exclude: []string{"train_b"}, NoDeps: true}, "train_a")
+
+	// Problems
+	bad := []StepSelector{
+		{Tags: []string{"nope"}},
+		{Names: []string{"nope*"}},
+		{Names: []string{"~("}},
+		{Exclude: []string{"nope"}},
+	}
+	for _, sel := range bad {
+		_, err = SelectSteps(cfg, sel)
+		assert.Error(err, "%+v", sel)
+	}
+}
+
+func TestDownstreamSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/select.yaml")
+	pcheck(err)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+
+	assert.Equal([]string{"train_a", "train_b"}, DownstreamSteps(cfg, cfg["features"]))
+	assert.Equal([]string{}, DownstreamSteps(cfg, cfg["report"]))
+
+	// From selects everything downstream (and their dependencies)
+	newCfg, err := SelectSteps(cfg, StepSelector{From: []string{"train_b"}})
+	assert.NoError(err)
+	assert.Len(newCfg, 5)
+	assert.Contains(newCfg, "report")
+	assert.NotContains(newCfg, "docs")
+
+	newCfg, err = SelectSteps(cfg, StepSelector{From: []string{"train_b"}, NoDeps: true})
+	assert.NoError(err)
+	assert.Len(newCfg, 2)
+
+	// Forcing marks everything downstream
+	forced, err := ForceSteps(cfg, []string{"features"})
+	assert.NoError(err)
+	assert.Equal([]string{"features", "report", "train_a", "train_b"}, forced)
+	assert.True(cfg["report"].Force)
+	assert.False(cfg["raw"].Force)
+	assert.False(cfg["docs"].Force)
+
+	_, err = ForceSteps(cfg, []string{"nope"})
+	assert.Error(err)
+}
+
+func TestDownstreamStepsAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := ReadConfig([]byte(`
+features:
+    command: "touch features.csv"
+    outputs: [features.csv]
+train:
+    command: "touch model.pkl"
+    inputs: [features.csv]
+    outputs: [model.pkl]
+summary:
+    command: "touch summary.txt"
+    outputs: [summary.txt]
+    needs: [train]
+publish:
+    command: "touch published.txt"
+    outputs: [published.txt]
+    after: [summary]
+`))
+	pcheck(err)
+
+	// After only orders steps, so it never makes a step downstream
+	assert.Equal([]string{"summary"}, DownstreamSteps(cfg, cfg["train"]))
+	assert.Equal([]string{}, DownstreamSteps(cfg, cfg["summary"]))
+	forced, err := ForceSteps(cfg, []string{"features"})
+	assert.NoError(err)
+	assert.Equal([]string{"features", "summary", "train"}, forced)
+	assert.False(cfg["publish"].Force)
+
+	newCfg, err := SelectSteps(cfg, StepSelector{From: []string{"train"}, NoDeps: true})
+	assert.NoError(err)
+	assert.Len(newCfg, 2)
+	assert.NotContains(newCfg, "publish")
+}
+
+func TestAlwaysConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := ReadConfig([]byte(`
+_global:
+    always: true
+fetch:
+    command: "curl -o api.json $URL"
+    outputs: [api.json]
+local:
+    command: "touch local.txt"
+    outputs: [local.txt]
+    always: false
+`))
+	pcheck(err)
+	assert.True(cfg["fetch"].Always)
+	assert.False(cfg["local"].Always)
+
+	AlwaysRun(cfg)
+	assert.True(cfg["local"].Always)
+}
+
+func TestTopoSort(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/select.yaml")
+	pcheck(err)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+
+	order, err := TopoSort(cfg)
+	assert.NoError(err)
+	assert.Equal([]string{"docs", "lint", "raw", "features", "train_a", "train_b", "report"}, order)
+
+	// Missing steps are ignored
+	newCfg, err := SelectSteps(cfg, StepSelector{Names: []string{"report", "features"}, NoDeps: true})
+	pcheck(err)
+	order, err = TopoSort(newCfg)
+	assert.NoError(err)
+	assert.Equal([]string{"features", "report"}, order)
+
+	cfg, err = ReadConfig([]byte(`
+a:
+    command: x
+    inputs: [b.txt]
+    outputs: [a.txt]
+b:
+    command: x
+    inputs: [a.txt]
+    outputs: [b.txt]
+`))
+	pcheck(err)
+	_, err = TopoSort(cfg)
+	assert.Error(err)
+}
+
+func TestShellConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/shells.yaml")
+	pcheck(err)
+	cfg, err := ReadConfig(cfgText)
+	assert.NoError(err)
+
+	assert.Equal(Shell{"sh"}, cfg["plain"].Shell)
+	assert.Equal(Shell{"python3"}, cfg["python"].Shell)
+	assert.Equal(Shell{"sh", "-e", "-c"}, cfg["listed"].Shell)
+	assert.Equal(Shell{"none"}, cfg["direct"].Shell)
+
+	_, err = ReadConfig([]byte("a:\n    command: x\n    outputs: [a]\n    shell: mystery\n"))
+	assert.Error(err)
+}
+
+func TestListCommandConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/execform.yaml")
+	pcheck(err)
+	cfg, err := ReadConfig(cfgText)
+	assert.NoError(err)
+
+	step := cfg["archive"]
+	assert.Equal("", step.Command)
+	assert.Equal([]string{"tar", "-cf", "my archive.tar", "@inputs"}, step.Args)
+	assert.True(step.HasCommand())
+	assert.Equal(`tar -cf "my archive.tar" @inputs`, step.CommandText())
+
+	// List commands are inherited and scalars are strings
+	cfg, err = ReadConfig([]byte(`
+base:
+    abstract: true
+    command: [sleep, 1]
+child:
+    baseStep: base
+    outputs: [x]
+own:
+    baseStep: base
+    command: echo hi
+    outputs: [y]
+`))
+	assert.NoError(err)
+	assert.Equal([]string{"sleep", "1"}, cfg["child"].Args)
+	assert.Equal("", cfg["child"].Command)
+	assert.Len(cfg["own"].Args, 0)
+	assert.Equal("echo hi", cfg["own"].CommandText())
+
+	// Arguments and commands are kept exactly as written
+	cfg, err = ReadConfig([]byte(`
+list:
+    command: [echo, 1.50, "010", 010, yes, ~, 0x1F]
+    outputs: [a]
+text:
+    command: 010
+    outputs: [b]
+`))
+	assert.NoError(err)
+	assert.Equal([]string{"echo", "1.50", "010", "010", "yes", "", "0x1F"}, cfg["list"].Args)
+	assert.Equal("010", cfg["text"].Command)
+	assert.Len(cfg["text"].Args, 0)
+
+	_, err = ReadConfig([]byte("a:\n    command: [echo, [nested]]\n    outputs: [a]\n"))
+	assert.Error(err)
+	_, err = ReadConfig([]byte("a:\n    command: {echo: hi}\n    outputs: [a]\n"))
+	assert.Error(err)
+
+	// There's no shell for a list command
+	_, err = ReadConfig([]byte("a:\n    command: [echo, hi]\n    shell: sh\n    outputs: [a]\n"))
+	assert.Error(err)
+}
+
+func TestWorkdirConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cwd, err := os.Getwd()
+	pcheck(err)
+
+	cfg, err := ReadConfig([]byte(`
+_global:
+    workdir: sub/$DIR
+a:
+    command: "cat ${rel:in.txt} > ${abs:out.txt}"
+    inputs: [in.txt]
+    outputs: [out.txt]
+    vars: {DIR: dir}
+b:
+    command: "cat ${rel:in.txt}"
+    outputs: [b.txt]
+    workdir: ""
+`))
+	assert.NoError(err)
+
+	step := cfg["a"]
+	assert.Equal("sub/dir", step.Workdir)
+	assert.Equal("cat ../../in.txt > "+filepath.Join(cwd, "out.txt"), step.Command)
+	assert.Equal([]string{"../../in.txt", "/abs/file"}, step.WorkdirPaths([]string{"in.txt", "/abs/file"}))
+
+	step = cfg["b"]
+	assert.Equal("", step.Workdir)
+	assert.Equal("cat in.txt", step.Command)
+}
+
+func TestStepEnvConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := ReadConfig([]byte(`
+_global:
+    env:
+        clean: true
+        pass: [PATH]
+        files: [common.env]
+a:
+    command: x
+    outputs: [a]
+    env:
+        pass: [HOME]
+        files: [$NAME.env]
+    vars: {NAME: a}
+b:
+    command: x
+    outputs: [b]
+    env:
+        clean: false
+`))
+	assert.NoError(err)
+
+	step := cfg["a"]
+	assert.True(step.Env.IsClean())
+	assert.Equal([]string{"HOME", "PATH"}, step.Env.Pass)
+	assert.Equal([]string{"a.env", "common.env"}, step.Env.Files)
+	assert.True(step.Env.Passes("HOME"))
+	assert.False(step.Env.Passes("HOMER"))
+
+	step = cfg["b"]
+	assert.False(step.Env.IsClean())
+	assert.Equal([]string{"PATH"}, step.Env.Pass)
+}
+
+func TestSecretsConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := ReadConfig([]byte(`
+_global:
+    secrets: [API_TOKEN]
+base:
+    abstract: true
+    secrets: ["*_KEY"]
+a:
+    baseStep: base
+    command: x
+    outputs: [a]
+    secrets: [PASSWORD]
+b:
+    command: x
+    outputs: [b]
+`))
+	assert.NoError(err)
+
+	step := cfg["a"]
+	assert.Equal([]string{"PASSWORD", "API_TOKEN", "*_KEY"}, step.Secrets)
+	assert.True(step.IsSecret("AWS_KEY"))
+	assert.True(step.IsSecret("API_TOKEN"))
+	assert.False(cfg["b"].IsSecret("AWS_KEY"))
+	assert.True(cfg["b"].IsSecret("API_TOKEN"))
+
+	masked := maskSecretVars(cfg, VarFlags{"AWS_KEY": "abc", "MODEL": "xgb"})
+	assert.Equal(VarFlags{"AWS_KEY": SecretMask, "MODEL": "xgb"}, masked)
+}
+
+func TestTraceConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := ReadConfig([]byte(`
+_global:
+    trace: true
+a:
+    command: x
+    outputs: [a]
+b:
+    command: x
+    outputs: [b]
+    trace: false
+`))
+	assert.NoError(err)
+	assert.True(cfg["a"].Trace)
+	assert.False(cfg["b"].Trace)
+
+	TraceAll(cfg)
+	assert.True(cfg["b"].Trace)
+}
+
+func TestContainerConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, err := ReadConfig([]byte(`
+_global:
+    image: "python:$PY"
+    runner: podman
+    vars: {PY: "3.8"}
+a:
+    command: x
+    outputs: [a]
+b:
+    command: x
+    outputs: [b]
+    image: alpine
+`))
+	assert.NoError(err)
+	assert.Equal("python:3.8", cfg["a"].Image)
+	assert.Equal("podman", cfg["a"].Runner)
+	assert.Equal("alpine", cfg["b"].Image)
+	assert.Equal("podman", cfg["b"].Runner)
+
+	_, err = ReadConfig([]byte("a:\n    command: x\n    runner: docker\n"))
+	assert.Error(err)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultRunner is the container runner used when a step has an image but
+// doesn't name a runner
+const DefaultRunner = "docker"
+
+// Mount is a host directory or file visible inside a container at the same
+// path
+type Mount struct {
+	Path     string
+	ReadOnly bool
+}
+
+// ContainerSpec is everything needed to run a step's command in a container
+type ContainerSpec struct {
+	Image   string
+	Argv    []string // Command to run inside the container
+	Env     []string // KEY=VALUE pairs set inside the container
+	Mounts  []Mount
+	Workdir string // Absolute directory the command runs in
+}
+
+// ContainerRunner runs a command inside a container. Output from the
+// command goes to stdout and stderr, and an error is returned if the command
+// fails.
+type ContainerRunner interface {
+	Run(spec ContainerSpec, stdout io.Writer, stderr io.Writer) error
+}
+
+// ContainerRunners are the runners a step may name with runner
+var ContainerRunners = map[string]ContainerRunner{
+	"docker": CLIRunner{Program: "docker"},
+	"podman": CLIRunner{Program: "podman"},
+}
+
+// CLIRunner runs containers with a docker compatible command line program
+type CLIRunner struct {
+	Program string
+}
+
+// Args returns the command line (after the program name) that runs the spec.
+// Only variable names are given on the command line so that values (like
+// secrets) aren't visible in the process list: Run sets the values in the
+// program's environment.
+func (cr CLIRunner) Args(spec ContainerSpec) []string {
+	args := []string{"run", "--rm"}
+	if filepath.Base(cr.Program) == "docker" {
+		// Otherwise outputs are owned by root. Podman maps users itself.
+		args = append(args, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+	}
+	for _, m := range spec.Mounts {
+		vol := m.Path + ":" + m.Path
+		if m.ReadOnly {
+			vol += ":ro"
+		}
+		args = append(args, "-v", vol)
+	}
+	if len(spec.Workdir) > 0 {
+		args = append(args, "-w", spec.Workdir)
+	}
+	for _, kv := range spec.Env {
+		args = append(args, "-e", envName(kv))
+	}
+	args = append(args, spec.Image)
+	return append(args, spec.Argv...)
+}
+
+// Run runs the spec with the program
+func (cr CLIRunner) Run(spec ContainerSpec, stdout io.Writer, stderr io.Writer) error {
+	cmd := exec.Command(cr.Program, cr.Args(spec)...)
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// envName returns the name from a KEY=VALUE pair
+func envName(kv string) string {
+	if eq := strings.Index(kv, "="); eq >= 0 {
+		return kv[:eq]
+	}
+	return kv
+}
+
+// ContainerRunner returns the runner for the step, or nil if the step
+// doesn't run in a container
+func (step *BuildStep) ContainerRunner() (ContainerRunner, error) {
+	if len(step.Image) < 1 {
+		if len(step.Runner) > 0 {
+			return nil, fmt.Errorf("runner %s given without an image", step.Runner)
+		}
+		return nil, nil
+	}
+	name := step.Runner
+	if len(name) < 1 {
+		name = DefaultRunner
+	}
+	runner, ok := ContainerRunners[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown container runner %s", name)
+	}
+	return runner, nil
+}
+
+// ContainerSpec returns the spec for running argv in the step's image. env
+// is the step's environment and tracked is the values from Environment: see
+// remoteEnv for what is set in the container. The pipeline directory is
+// mounted, as are any inputs (read only) or the directories of any outputs
+// outside of it.
+func (step *BuildStep) ContainerSpec(argv []string, env []string, tracked map[string]string, inputs []string) (ContainerSpec, error) {
+	spec := ContainerSpec{Image: step.Image, Argv: argv, Env: remoteEnv(env, tracked)}
+
+	root, err := os.Getwd()
+	if err != nil {
+		return spec, err
+	}
+	spec.Workdir = root
+	if len(step.Workdir) > 0 {
+		if spec.Workdir, err = filepath.Abs(step.Workdir); err != nil {
+			return spec, err
+		}
+	}
+
+	// Mount the pipeline directory, and anything outside it
+	mounts := map[string]bool{root: false}
+	outside := func(path string) (string, bool, error) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", false, err
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil {
+			return "", false, err
+		}
+		return abs, rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+	}
+	for _, in := range inputs {
+		abs, out, err := outside(in)
+		if err != nil {
+			return spec, err
+		}
+		if out {
+			if _, ok := mounts[abs]; !ok {
+				mounts[abs] = true
+			}
+		}
+	}
+	for _, o := range step.Outputs {
+		abs, out, err := outside(o)
+		if err != nil {
+			return spec, err
+		}
+		if out {
+			mounts[filepath.Dir(abs)] = false // Must be writable
+		}
+	}
+
+	paths := make([]string, 0, len(mounts))
+	for p := range mounts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		spec.Mounts = append(spec.Mounts, Mount{Path: p, ReadOnly: mounts[p]})
+	}
+	return spec, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCLIRunnerArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := ContainerSpec{
+		Image:   "python:3.8",
+		Argv:    []string{"/bin/bash", "-c", "make"},
+		Env:     []string{"DMK_STEPNAME=step", "TOKEN=secret"},
+		Mounts:  []Mount{{Path: "/work"}, {Path: "/data/in.csv", ReadOnly: true}},
+		Workdir: "/work/sub",
+	}
+
+	assert.Equal([]string{
+		"run", "--rm",
+		"-v", "/work:/work",
+		"-v", "/data/in.csv:/data/in.csv:ro",
+		"-w", "/work/sub",
+		"-e", "DMK_STEPNAME",
+		"-e", "TOKEN",
+		"python:3.8", "/bin/bash", "-c", "make",
+	}, CLIRunner{Program: "podman"}.Args(spec))
+
+	args := CLIRunner{Program: "/usr/bin/docker"}.Args(spec)
+	assert.Equal([]string{"run", "--rm", "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}, args[:4])
+	assert.NotContains(args, "TOKEN=secret")
+}
+
+func TestContainerRunner(t *testing.T) {
+	assert := assert.New(t)
+
+	runner, err := (&BuildStep{}).ContainerRunner()
+	assert.NoError(err)
+	assert.Nil(runner)
+
+	runner, err = (&BuildStep{Image: "alpine"}).ContainerRunner()
+	assert.NoError(err)
+	assert.Equal(CLIRunner{Program: "docker"}, runner)
+
+	runner, err = (&BuildStep{Image: "alpine", Runner: "podman"}).ContainerRunner()
+	assert.NoError(err)
+	assert.Equal(CLIRunner{Program: "podman"}, runner)
+
+	_, err = (&BuildStep{Image: "alpine", Runner: "nope"}).ContainerRunner()
+	assert.Error(err)
+	_, err = (&BuildStep{Runner: "podman"}).ContainerRunner()
+	assert.Error(err)
+}
+
+func TestContainerSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := os.Getwd()
+	pcheck(err)
+	outside := filepath.Join(filepath.Dir(root), "elsewhere")
+
+	step := &BuildStep{
+		Image:   "alpine",
+		Workdir: "res",
+		Outputs: []string{"out.txt", filepath.Join(outside, "out", "b.txt")},
+	}
+	spec, err := step.ContainerSpec(
+		[]string{"sh", "-c", "x"},
+		[]string{"DMK_INPUTS=a", "HOME=/home/me", "PATH=/bin", "TOKEN=t"},
+		map[string]string{"TOKEN": "t"},
+		[]string{"in.txt", filepath.Join(outside, "a.txt")},
+	)
+	assert.NoError(err)
+	assert.Equal("alpine", spec.Image)
+	assert.Equal([]string{"sh", "-c", "x"}, spec.Argv)
+	assert.Equal([]string{"DMK_INPUTS=a", "TOKEN=t"}, spec.Env)
+	assert.Equal(filepath.Join(root, "res"), spec.Workdir)
+	assert.Len(spec.Mounts, 3)
+	assert.Contains(spec.Mounts, Mount{Path: root})
+	assert.Contains(spec.Mounts, Mount{Path: filepath.Join(outside, "a.txt"), ReadOnly: true})
+	assert.Contains(spec.Mounts, Mount{Path: filepath.Join(outside, "out")})
+}
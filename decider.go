@@ -1,6 +1,12 @@
 package main
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 // Decider is something that determines if a build step should run
 type Decider interface {
@@ -8,40 +14,119 @@ type Decider interface {
 	NeedBuild(inputs []string, outputs []string) (bool, error)
 }
 
+// Explainer is a Decider that can also describe why it made a decision
+type Explainer interface {
+	Decider
+	// Explain returns the same thing as NeedBuild along with the reason
+	Explain(inputs []string, outputs []string) (bool, string, error)
+}
+
 // TimeDecider forces a build if any input is newer than any output
 // This is the default build decider
-type TimeDecider struct{}
+type TimeDecider struct {
+	// Filter selects the files used for directory inputs
+	Filter DirFilter
+	// If HashDirs is true, directory inputs are compared by content hash to
+	// DirHashes (the hashes from the last build) instead of by time
+	HashDirs  bool
+	DirHashes map[string]string
+}
 
 // NeedBuild - return true if need a build
 func (td TimeDecider) NeedBuild(inputs []string, outputs []string) (bool, error) {
+	need, _, err := td.Explain(inputs, outputs)
+	return need, err
+}
+
+// Explain is NeedBuild, but also returns the reason for the decision
+func (td TimeDecider) Explain(inputs []string, outputs []string) (bool, string, error) {
 	if len(outputs) < 1 {
-		return false, errors.New("Nothing to build")
+		return false, "", errors.New("Nothing to build")
 	}
 
-	if missing, err := AnyMissing(inputs); missing || err != nil {
+	if missing, err := FirstMissing(inputs); missing != "" || err != nil {
 		// If there was an error or we couldn't find the inputs, then we can't
 		// build anything (missing deps)
 		if err != nil {
-			return true, errors.Wrap(err, "Error checking dependency: cannot build")
+			return true, "", errors.Wrap(err, "Error checking dependency: cannot build")
 		}
-		return true, errors.New("Missing a dependency: cannot build")
+		return true, fmt.Sprintf("input %s is missing", missing), errors.New("Missing a dependency: cannot build")
 	}
 
-	if missing, err := AnyMissing(outputs); missing || err != nil {
+	if missing, err := FirstMissing(outputs); missing != "" || err != nil {
 		// Either we have an output missing or an error: either way we're done
-		return missing, err
+		return true, fmt.Sprintf("output %s is missing", missing), err
 	}
 
-	inputMaxTime, err := MaxTime(inputs)
+	if td.HashDirs {
+		timed, reason, err := td.checkDirHashes(inputs)
+		if err != nil || reason != "" {
+			return reason != "", reason, err
+		}
+		inputs = timed
+	}
+
+	newestInput, inputMaxTime, err := td.Filter.Newest(inputs)
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
-	outputMinTime, err := MinTime(outputs)
+	oldestOutput, outputMinTime, err := DirFilter{}.Oldest(outputs)
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 	if outputMinTime.Before(inputMaxTime) {
-		return true, nil // Need a build
+		// Need a build
+		return true, fmt.Sprintf("input %s (%s) is newer than output %s (%s)",
+			newestInput, inputMaxTime.Format(time.RFC3339Nano),
+			oldestOutput, outputMinTime.Format(time.RFC3339Nano)), nil
+	}
+	return false, "every output is newer than every input", nil // Everything OK - no build
+}
+
+// checkDirHashes compares the hash of every directory input to the hash
+// from the last build. It returns the inputs that are NOT directories (so
+// they can be checked by time) and the reason a build is needed if any
+// directory has changed.
+func (td TimeDecider) checkDirHashes(inputs []string) ([]string, string, error) {
+	hashes, err := td.CurrentHashes(inputs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	timed := make([]string, 0, len(inputs))
+	for _, file := range inputs {
+		hash, isDir := hashes[file]
+		if !isDir {
+			timed = append(timed, file)
+			continue
+		}
+		prev, ok := td.DirHashes[file]
+		if !ok {
+			return timed, fmt.Sprintf("no hash recorded for directory input %s", file), nil
+		}
+		if prev != hash {
+			return timed, fmt.Sprintf("directory input %s changed (hash %s, was %s)", file, hash, prev), nil
+		}
+	}
+	return timed, "", nil
+}
+
+// CurrentHashes returns the content hash of every directory input
+func (td TimeDecider) CurrentHashes(inputs []string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, file := range inputs {
+		s, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if !s.IsDir() {
+			continue
+		}
+		hash, err := td.Filter.Hash(file)
+		if err != nil {
+			return nil, err
+		}
+		hashes[file] = hash
 	}
-	return false, nil // Everything OK - no build
+	return hashes, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -75,3 +76,110 @@ func TestTimeDecider(t *testing.T) {
 	assert.True(b)
 	assert.NotNil(e)
 }
+
+func TestDirectoryInputs(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	pcheck(os.MkdirAll(filepath.Join(src, "deep"), 0755))
+	deep := filepath.Join(src, "deep", "code.py")
+	pcheck(ioutil.WriteFile(deep, []byte("print(1)"), 0644))
+	out := filepath.Join(dir, "out.txt")
+	pcheck(ioutil.WriteFile(out, []byte("output"), 0644))
+
+	then := time.Now().Add(-time.Hour)
+	pcheck(os.Chtimes(deep, then, then))
+	pcheck(os.Chtimes(src, time.Now(), time.Now()))
+
+	// The directory's own time doesn't matter, only the files
+	var d Decider = TimeDecider{}
+	b, e := d.NeedBuild([]string{src}, []string{out})
+	assert.False(b)
+	assert.NoError(e)
+
+	pcheck(os.Chtimes(deep, time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+	b, e = d.NeedBuild([]string{src}, []string{out})
+	assert.True(b)
+	assert.NoError(e)
+
+	// Unless the file is excluded (and then the empty directory's time is used)
+	pcheck(os.Chtimes(src, then, then))
+	d = TimeDecider{Filter: DirFilter{Exclude: []string{"*.py"}}}
+	b, e = d.NeedBuild([]string{src}, []string{out})
+	assert.False(b)
+	assert.NoError(e)
+
+	// With hashing, times don't matter but content does
+	td := TimeDecider{HashDirs: true}
+	b, e = td.NeedBuild([]string{src}, []string{out})
+	assert.True(b) // Nothing recorded
+	assert.NoError(e)
+
+	td.DirHashes, e = td.CurrentHashes([]string{src, out})
+	assert.NoError(e)
+	assert.Len(td.DirHashes, 1)
+	b, e = td.NeedBuild([]string{src}, []string{out})
+	assert.False(b)
+	assert.NoError(e)
+
+	pcheck(ioutil.WriteFile(deep, []byte("print(2)"), 0644))
+	b, e = td.NeedBuild([]string{src}, []string{out})
+	assert.True(b)
+	assert.NoError(e)
+}
+
+func TestExplain(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+
+	p := func(name string) string { return filepath.Join(dir, name) }
+	for _, f := range []string{"in1", "in2", "out1", "out2"} {
+		pcheck(ioutil.WriteFile(p(f), []byte(f), 0644))
+	}
+	then := time.Now().Add(-time.Hour)
+	pcheck(os.Chtimes(p("in1"), then, then))
+	pcheck(os.Chtimes(p("in2"), then.Add(time.Minute), then.Add(time.Minute)))
+
+	var ex Explainer = TimeDecider{}
+
+	b, reason, e := ex.Explain([]string{p("in1"), p("in2")}, []string{p("out1"), p("out2")})
+	assert.False(b)
+	assert.NoError(e)
+	assert.Equal("every output is newer than every input", reason)
+
+	// The newest input and oldest output are named
+	pcheck(os.Chtimes(p("out2"), then.Add(30*time.Second), then.Add(30*time.Second)))
+	b, reason, e = ex.Explain([]string{p("in1"), p("in2")}, []string{p("out1"), p("out2")})
+	assert.True(b)
+	assert.NoError(e)
+	assert.Contains(reason, "input "+p("in2")+" (")
+	assert.Contains(reason, "newer than output "+p("out2")+" (")
+
+	b, reason, e = ex.Explain([]string{p("in1")}, []string{p("out1"), p("nope")})
+	assert.True(b)
+	assert.NoError(e)
+	assert.Equal("output "+p("nope")+" is missing", reason)
+
+	_, reason, e = ex.Explain([]string{p("nope")}, []string{p("out1")})
+	assert.Error(e)
+	assert.Equal("input "+p("nope")+" is missing", reason)
+
+	// Directory hashes
+	pcheck(os.Mkdir(p("src"), 0755))
+	b, reason, e = TimeDecider{HashDirs: true}.Explain([]string{p("src")}, []string{p("out1")})
+	assert.True(b)
+	assert.NoError(e)
+	assert.Equal("no hash recorded for directory input "+p("src"), reason)
+
+	b, reason, e = TimeDecider{HashDirs: true, DirHashes: map[string]string{p("src"): "old"}}.Explain([]string{p("src")}, []string{p("out1")})
+	assert.True(b)
+	assert.NoError(e)
+	assert.Contains(reason, "directory input "+p("src")+" changed")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// StepEnv controls the environment a step's command runs with
+type StepEnv struct {
+	// If Clean is true, the command does NOT inherit dmk's environment:
+	// only the variables in Pass are copied
+	Clean *bool `yaml:"clean"`
+	// Names (or glob patterns like LC_*) of variables passed from dmk's
+	// environment. These are also tracked for changes.
+	Pass []string `yaml:"pass"`
+	// Env files (like the -e command line parameter) loaded for the step
+	Files []string `yaml:"files"`
+}
+
+// IsClean returns true if the command starts with an empty environment
+func (se StepEnv) IsClean() bool {
+	return se.Clean != nil && *se.Clean
+}
+
+// Passes returns true if the variable is in the pass list
+func (se StepEnv) Passes(name string) bool {
+	for _, p := range se.Pass {
+		if m, err := filepath.Match(p, name); err == nil && m {
+			return true
+		}
+	}
+	return false
+}
+
+// merge fills in anything missing from a base step or the global section
+func (se *StepEnv) merge(from StepEnv) {
+	if se.Clean == nil && from.Clean != nil {
+		clean := *from.Clean
+		se.Clean = &clean
+	}
+	se.Pass = append(se.Pass, from.Pass...)
+	se.Files = append(se.Files, from.Files...)
+}
+
+// Environment returns the KEY=VALUE environment for the step's command,
+// along with the values tracked for changes: everything from the step's env
+// files, passed variables, and step variables (except the DMK_ variables).
+// Values are added in this order, with later values replacing earlier ones:
+// dmk's environment (or only the passed variables for a clean environment),
+// the step's env files, the dmkVars given, and the step variables.
+func (step *BuildStep) Environment(dmkVars map[string]string) ([]string, map[string]string, error) {
+	env := make(map[string]string)
+	tracked := make(map[string]string)
+
+	for _, kv := range os.Environ() {
+		eq := strings.Index(kv, "=")
+		if eq < 1 {
+			continue
+		}
+		k, v := kv[:eq], kv[eq+1:]
+		passed := step.Env.Passes(k)
+		if passed {
+			tracked[k] = v
+		}
+		if passed || !step.Env.IsClean() {
+			env[k] = v
+		}
+	}
+
+	if len(step.Env.Files) > 0 {
+		fileVars, err := godotenv.Read(step.Env.Files...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not read env files: %v", err)
+		}
+		for k, v := range fileVars {
+			env[k] = v
+			tracked[k] = v
+		}
+	}
+
+	for k, v := range dmkVars {
+		env[k] = v
+	}
+
+	for k, v := range step.Vars {
+		env[k] = v
+		if !strings.HasPrefix(k, "DMK_") {
+			tracked[k] = v
+		}
+	}
+
+	pairs := make([]string, 0, len(env))
+	for k, v := range env {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs, tracked, nil
+}
+
+// SecretMask replaces the value of a secret in anything dmk prints
+const SecretMask = "*****"
+
+// IsSecret returns true if the variable is one of the step's secrets. Like
+// env pass names, secrets may be glob patterns.
+func (step *BuildStep) IsSecret(name string) bool {
+	for _, p := range step.Secrets {
+		if m, err := filepath.Match(p, name); err == nil && m {
+			return true
+		}
+	}
+	return false
+}
+
+// Redactor returns a replacer that masks the value of every secret. Values
+// are found in the step variables, dmk's environment, and the KEY=VALUE
+// pairs in env (see Environment).
+func (step *BuildStep) Redactor(env []string) *strings.Replacer {
+	values := NewUniqueStrings()
+	add := func(k string, v string) {
+		if len(v) > 0 && step.IsSecret(k) {
+			values.Add(v)
+		}
+	}
+
+	for k, v := range step.Vars {
+		add(k, v)
+	}
+	for _, kv := range append(os.Environ(), env...) {
+		if eq := strings.Index(kv, "="); eq > 0 {
+			add(kv[:eq], kv[eq+1:])
+		}
+	}
+
+	// The replacer tries the old strings in order, so longer values must come
+	// first in case one secret contains another
+	secrets := values.Strings()
+	sort.SliceStable(secrets, func(a, b int) bool {
+		return len(secrets[a]) > len(secrets[b])
+	})
+	pairs := make([]string, 0, len(secrets)*2)
+	for _, v := range secrets {
+		pairs = append(pairs, v, SecretMask)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// Fingerprint returns the hash of every tracked value: the values themselves
+// are never kept. Secrets (if isSecret isn't nil) are hashed along with the
+// salt so that their hashes can't be looked up or matched across pipelines.
+func Fingerprint(tracked map[string]string, isSecret func(string) bool, salt string) map[string]string {
+	fp := make(map[string]string, len(tracked))
+	for k, v := range tracked {
+		if isSecret != nil && isSecret(k) {
+			mac := hmac.New(sha256.New, []byte(salt))
+			mac.Write([]byte(v))
+			fp[k] = hex.EncodeToString(mac.Sum(nil))
+			continue
+		}
+		sum := sha256.Sum256([]byte(v))
+		fp[k] = hex.EncodeToString(sum[:])
+	}
+	return fp
+}
+
+// FingerprintChange describes the first difference (by name) between two
+// fingerprints, or returns an empty string if they are the same
+func FingerprintChange(prev map[string]string, curr map[string]string) string {
+	names := NewUniqueStrings()
+	for k := range prev {
+		names.Add(k)
+	}
+	for k := range curr {
+		names.Add(k)
+	}
+
+	for _, k := range names.Strings() {
+		p, inPrev := prev[k]
+		c, inCurr := curr[k]
+		switch {
+		case !inPrev:
+			return fmt.Sprintf("variable %s was added", k)
+		case !inCurr:
+			return fmt.Sprintf("variable %s was removed", k)
+		case p != c:
+			return fmt.Sprintf("variable %s changed", k)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+	envFile := filepath.Join(dir, "step.env")
+	pcheck(ioutil.WriteFile(envFile, []byte("FROM_FILE=file\nSHARED=file\n"), 0644))
+
+	pcheck(os.Setenv("DMK_TEST_PASSED", "passed"))
+	pcheck(os.Setenv("DMK_TEST_OTHER", "other"))
+	defer os.Unsetenv("DMK_TEST_PASSED")
+	defer os.Unsetenv("DMK_TEST_OTHER")
+
+	clean := true
+	step := &BuildStep{
+		Name: "step",
+		Vars: map[string]string{"SHARED": "var", "DMK_STEPNAME": "step"},
+		Env: StepEnv{
+			Clean: &clean,
+			Pass:  []string{"DMK_TEST_P*"},
+			Files: []string{envFile},
+		},
+	}
+
+	env, tracked, err := step.Environment(map[string]string{"DMK_INPUTS": "a:b"})
+	assert.NoError(err)
+	assert.Equal([]string{
+		"DMK_INPUTS=a:b",
+		"DMK_STEPNAME=step",
+		"DMK_TEST_PASSED=passed",
+		"FROM_FILE=file",
+		"SHARED=var",
+	}, env)
+	assert.Equal(map[string]string{
+		"DMK_TEST_PASSED": "passed",
+		"FROM_FILE":       "file",
+		"SHARED":          "var",
+	}, tracked)
+
+	// Without a clean environment, everything is inherited but only the
+	// passed variables are tracked
+	step.Env.Clean = nil
+	env, tracked, err = step.Environment(nil)
+	assert.NoError(err)
+	assert.Contains(env, "DMK_TEST_OTHER=other")
+	assert.Len(tracked, 3)
+
+	step.Env.Files = []string{filepath.Join(dir, "missing.env")}
+	_, _, err = step.Environment(nil)
+	assert.Error(err)
+}
+
+func TestFingerprint(t *testing.T) {
+	assert := assert.New(t)
+
+	fp := Fingerprint(map[string]string{"A": "1", "B": "2"}, nil, "")
+	assert.Len(fp, 2)
+	assert.NotEqual("1", fp["A"])
+	assert.Len(fp["A"], 64)
+
+	assert.Equal("", FingerprintChange(fp, Fingerprint(map[string]string{"B": "2", "A": "1"}, nil, "")))
+	assert.Equal("variable A changed", FingerprintChange(fp, Fingerprint(map[string]string{"A": "x", "B": "2"}, nil, "")))
+	assert.Equal("variable B was removed", FingerprintChange(fp, Fingerprint(map[string]string{"A": "1"}, nil, "")))
+	assert.Equal("variable C was added", FingerprintChange(fp, Fingerprint(map[string]string{"A": "1", "B": "2", "C": ""}, nil, "")))
+}
+
+func TestSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	pcheck(os.Setenv("DMK_TEST_SECRET", "from-env"))
+	defer os.Unsetenv("DMK_TEST_SECRET")
+
+	step := &BuildStep{
+		Name:    "step",
+		Vars:    map[string]string{"API_KEY": "abc", "LONG_KEY": "abcdef", "OTHER": "abc"},
+		Secrets: []string{"*_KEY", "DMK_TEST_SECRET", "FROM_FILE"},
+	}
+	assert.True(step.IsSecret("API_KEY"))
+	assert.True(step.IsSecret("DMK_TEST_SECRET"))
+	assert.False(step.IsSecret("OTHER"))
+
+	redact := step.Redactor([]string{"FROM_FILE=file-value", "PLAIN=abc"})
+	assert.Equal("key=***** long=***** env=***** file=*****",
+		redact.Replace("key=abc long=abcdef env=from-env file=file-value"))
+	assert.Equal("nothing here", (&BuildStep{}).Redactor(nil).Replace("nothing here"))
+
+	// Secrets are hashed with the salt, everything else isn't
+	tracked := map[string]string{"API_KEY": "abc", "OTHER": "abc"}
+	fp := Fingerprint(tracked, step.IsSecret, "salt")
+	assert.Equal(Fingerprint(tracked, nil, "")["OTHER"], fp["OTHER"])
+	assert.NotEqual(fp["OTHER"], fp["API_KEY"])
+	assert.NotEqual(fp["API_KEY"], Fingerprint(tracked, step.IsSecret, "other salt")["API_KEY"])
+	assert.Equal(fp, Fingerprint(tracked, step.IsSecret, "salt"))
+	tracked["API_KEY"] = "changed"
+	assert.Equal("variable API_KEY changed", FingerprintChange(fp, Fingerprint(tracked, step.IsSecret, "salt")))
+}
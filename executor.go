@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the built in executors
+const (
+	LocalExecutorName     = "local"
+	ContainerExecutorName = "container"
+)
+
+// Job is a step's command ready to run, with everything an executor needs
+type Job struct {
+	Step    *BuildStep
+	Argv    []string          // Program and arguments to run
+	Env     []string          // KEY=VALUE environment for the command
+	Tracked map[string]string // Tracked values from the environment
+	Inputs  []string          // Step inputs after globbing
+	Stdout  io.Writer
+	Stderr  io.Writer
+	Verb    *log.Logger
+}
+
+// Executor runs a job somewhere, waiting for it to finish. Output from the
+// command goes to the job's Stdout and Stderr, and an error is returned if
+// the command fails. Deciding if the step should run and checking its
+// outputs afterwards are done by the BuildStepInstance, so executors only
+// need to run the command.
+type Executor interface {
+	Execute(job Job) error
+}
+
+// StepChecker is implemented by executors that need settings from the step:
+// CheckStep returns an error if the step can't be run by the executor, and is
+// called when the pipeline file is read
+type StepChecker interface {
+	CheckStep(step *BuildStep) error
+}
+
+// Executors are the executors a step may name with executor
+var Executors = map[string]Executor{
+	LocalExecutorName:     LocalExecutor{},
+	ContainerExecutorName: ContainerExecutor{},
+	SSHExecutorName:       SSHExecutor{SSH: "ssh", SCP: "scp"},
+	SlurmExecutorName:     SlurmExecutor{Sbatch: "sbatch", Squeue: "squeue", Poll: 5 * time.Second},
+}
+
+// ExecutorNames returns the names of every executor in sorted order
+func ExecutorNames() []string {
+	names := make([]string, 0, len(Executors))
+	for name := range Executors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExecutorName returns the name of the executor for the step: the one it
+// names, or else container if it has an image, or else local
+func (step *BuildStep) ExecutorName() string {
+	switch {
+	case len(step.Executor) > 0:
+		return step.Executor
+	case len(step.Image) > 0:
+		return ContainerExecutorName
+	default:
+		return LocalExecutorName
+	}
+}
+
+// LookupExecutor returns the executor for the step
+func (step *BuildStep) LookupExecutor() (Executor, error) {
+	name := step.ExecutorName()
+	exe, ok := Executors[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown executor %s (known executors are %v)", name, ExecutorNames())
+	}
+	if checker, ok := exe.(StepChecker); ok {
+		if err := checker.CheckStep(step); err != nil {
+			return nil, err
+		}
+	}
+	return exe, nil
+}
+
+// remoteEnv returns the KEY=VALUE pairs from env to set for a command that
+// doesn't run directly on this machine (in a container, on another host, or
+// as a batch job): only the DMK_ variables and the tracked values (step vars,
+// env files, and passed variables) are set
+func remoteEnv(env []string, tracked map[string]string) []string {
+	pairs := []string{}
+	for _, kv := range env {
+		name := envName(kv)
+		if _, ok := tracked[name]; ok || strings.HasPrefix(name, "DMK_") {
+			pairs = append(pairs, kv)
+		}
+	}
+	return pairs
+}
+
+// LocalExecutor runs the command on this machine in the step's working
+// directory
+type LocalExecutor struct{}
+
+// Execute runs the job's command
+func (LocalExecutor) Execute(job Job) error {
+	cmd := exec.Command(job.Argv[0], job.Argv[1:]...)
+	cmd.Env = job.Env
+	cmd.Dir = job.Step.Workdir
+	cmd.Stdout = job.Stdout
+	cmd.Stderr = job.Stderr
+	return cmd.Run()
+}
+
+// ContainerExecutor runs the command in a container from the step's image
+// with the step's container runner
+type ContainerExecutor struct{}
+
+// CheckStep makes sure the step has an image
+func (ContainerExecutor) CheckStep(step *BuildStep) error {
+	if len(step.Image) < 1 {
+		return fmt.Errorf("an image is required for the %s executor", ContainerExecutorName)
+	}
+	return nil
+}
+
+// Execute runs the job's command in a container
+func (ce ContainerExecutor) Execute(job Job) error {
+	if err := ce.CheckStep(job.Step); err != nil {
+		return err
+	}
+	runner, err := job.Step.ContainerRunner()
+	if err != nil {
+		return err
+	}
+	spec, err := job.Step.ContainerSpec(job.Argv, job.Env, job.Tracked, job.Inputs)
+	if err != nil {
+		return err
+	}
+	job.Verb.Printf("%s: running in image %s\n", job.Step.Name, spec.Image)
+	for _, kv := range spec.Env {
+		job.Verb.Printf("%s: passing %s to the container\n", job.Step.Name, envName(kv))
+	}
+	return runner.Run(spec, job.Stdout, job.Stderr)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecutorName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(LocalExecutorName, (&BuildStep{}).ExecutorName())
+	assert.Equal(ContainerExecutorName, (&BuildStep{Image: "alpine"}).ExecutorName())
+	assert.Equal(LocalExecutorName, (&BuildStep{Image: "alpine", Executor: "local"}).ExecutorName())
+
+	exe, err := (&BuildStep{}).LookupExecutor()
+	assert.NoError(err)
+	assert.Equal(LocalExecutor{}, exe)
+	exe, err = (&BuildStep{Image: "alpine"}).LookupExecutor()
+	assert.NoError(err)
+	assert.Equal(ContainerExecutor{}, exe)
+
+	_, err = (&BuildStep{Executor: "nope"}).LookupExecutor()
+	assert.Error(err)
+	assert.Contains(ExecutorNames(), LocalExecutorName)
+}
+
+func TestRemoteEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	env := []string{"DMK_STEPNAME=train", "HOME=/home/me", "MODEL=xgb", "TOKEN=abc"}
+	tracked := map[string]string{"MODEL": "xgb", "TOKEN": "abc"}
+	assert.Equal([]string{"DMK_STEPNAME=train", "MODEL=xgb", "TOKEN=abc"}, remoteEnv(env, tracked))
+	assert.Equal([]string{"DMK_STEPNAME=train"}, remoteEnv(env, nil))
+}
+
+func TestLocalExecutor(t *testing.T) {
+	assert := assert.New(t)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	job := Job{
+		Step:   &BuildStep{Name: "local", Workdir: "res"},
+		Argv:   []string{"/bin/bash", "-c", "echo $GREETING; ls shells.yaml; echo oops 1>&2"},
+		Env:    []string{"GREETING=hello", "PATH=" + os.Getenv("PATH")},
+		Stdout: stdout,
+		Stderr: stderr,
+		Verb:   log.New(ioutil.Discard, "", 0),
+	}
+	assert.NoError(LocalExecutor{}.Execute(job))
+	assert.Equal("hello\nshells.yaml\n", stdout.String())
+	assert.Equal("oops\n", stderr.String())
+
+	job.Argv = []string{"/bin/bash", "-c", "exit 3"}
+	assert.Error(LocalExecutor{}.Execute(job))
+}
+
+func TestContainerExecutor(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := &fakeRunner{}
+	ContainerRunners["fake"] = runner
+	defer delete(ContainerRunners, "fake")
+
+	stdout := &bytes.Buffer{}
+	job := Job{
+		Step:    &BuildStep{Name: "boxed", Image: "alpine", Runner: "fake"},
+		Argv:    []string{"/bin/bash", "-c", "echo $MODEL"},
+		Env:     []string{"MODEL=xgb", "OTHER=x"},
+		Tracked: map[string]string{"MODEL": "xgb"},
+		Stdout:  stdout,
+		Stderr:  ioutil.Discard,
+		Verb:    log.New(ioutil.Discard, "", 0),
+	}
+	assert.NoError(ContainerExecutor{}.Execute(job))
+	assert.Equal("xgb\n", stdout.String())
+	assert.Len(runner.specs, 1)
+	assert.Equal([]string{"MODEL=xgb"}, runner.specs[0].Env)
+
+	job.Step = &BuildStep{Name: "unboxed"}
+	assert.Error(ContainerExecutor{}.Execute(job))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// copyStep returns a deep copy of the build step
+func copyStep(step *BuildStep) *BuildStep {
+	dup := *step
+
+	dup.Inputs = append([]string(nil), step.Inputs...)
+	dup.Outputs = append([]string(nil), step.Outputs...)
+	dup.Clean = append([]string(nil), step.Clean...)
+	dup.DirInclude = append([]string(nil), step.DirInclude...)
+	dup.DirExclude = append([]string(nil), step.DirExclude...)
+	dup.Needs = append([]string(nil), step.Needs...)
+	dup.After = append([]string(nil), step.After...)
+	dup.Tags = append([]string(nil), step.Tags...)
+	dup.Args = append([]string(nil), step.Args...)
+	dup.Shell = append(Shell(nil), step.Shell...)
+	dup.Env.Pass = append([]string(nil), step.Env.Pass...)
+	dup.Env.Files = append([]string(nil), step.Env.Files...)
+	dup.Secrets = append([]string(nil), step.Secrets...)
+	dup.Resources.Options = append([]string(nil), step.Resources.Options...)
+	dup.ancestors = append([]string(nil), step.ancestors...)
+
+	dup.Vars = make(map[string]string, len(step.Vars))
+	for k, v := range step.Vars {
+		dup.Vars[k] = v
+	}
+	dup.given = make(map[string]bool, len(step.given))
+	for k, v := range step.given {
+		dup.given[k] = v
+	}
+
+	// Generated steps don't need the matrix (and can't be expanded again)
+	dup.Matrix = nil
+
+	return &dup
+}
+
+// expandMatrixSteps returns a new config file where every step with a
+// matrix is replaced by one step per combination of matrix values
+func expandMatrixSteps(cfg ConfigFile) (ConfigFile, error) {
+	newCfg := ConfigFile{}
+
+	// Steps without a matrix just get copied: we do these first so that we can
+	// detect generated names that collide with them
+	for name, step := range cfg {
+		if len(step.Matrix) < 1 {
+			newCfg[name] = step
+		}
+	}
+
+	for _, step := range cfg {
+		if len(step.Matrix) < 1 {
+			continue
+		}
+
+		variants, err := expandMatrix(step)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range variants {
+			if _, inMap := newCfg[v.Name]; inMap {
+				return nil, fmt.Errorf("%s: generated step %s already exists", step.Name, v.Name)
+			}
+			newCfg[v.Name] = v
+		}
+	}
+
+	return newCfg, nil
+}
+
+// expandMatrix returns one step per combination of the step's matrix
+// values. Each combination's values are added to the step's vars and the
+// step is named with the values in order of their (sorted) keys: e.g. a step
+// named train with the matrix {model: [a, b], data: [x]} becomes the steps
+// train.x.a and train.x.b
+func expandMatrix(step *BuildStep) ([]*BuildStep, error) {
+	keys := make([]string, 0, len(step.Matrix))
+	for k, vals := range step.Matrix {
+		if len(vals) < 1 {
+			return nil, fmt.Errorf("%s: matrix key %s has no values", step.Name, k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	variants := []*BuildStep{}
+	combo := make([]string, len(keys))
+
+	var expand func(idx int)
+	expand = func(idx int) {
+		if idx >= len(keys) {
+			v := copyStep(step)
+			v.Name = step.Name + "." + strings.Join(combo, ".")
+			v.Origin = step.Name
+			for i, k := range keys {
+				v.Vars[k] = combo[i]
+			}
+			variants = append(variants, v)
+			return
+		}
+		for _, val := range step.Matrix[keys[idx]] {
+			combo[idx] = val
+			expand(idx + 1)
+		}
+	}
+	expand(0)
+
+	return variants, nil
+}
+
+// PatternStem is the character in a pattern input that matches the stem
+const PatternStem = "%"
+
+// expandPatternSteps returns a new config file where every pattern step is
+// replaced by one step per file matching its pattern input
+func expandPatternSteps(cfg ConfigFile) (ConfigFile, error) {
+	newCfg := ConfigFile{}
+
+	for name, step := range cfg {
+		if !step.Pattern {
+			newCfg[name] = step
+		}
+	}
+
+	for _, step := range cfg {
+		if !step.Pattern {
+			continue
+		}
+
+		generated, err := expandPattern(step)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range generated {
+			if _, inMap := newCfg[g.Name]; inMap {
+				return nil, fmt.Errorf("%s: generated step %s already exists", step.Name, g.Name)
+			}
+			newCfg[g.Name] = g
+		}
+	}
+
+	return newCfg, nil
+}
+
+// patternInput returns the index of the first input containing the stem
+// character, or -1 if there isn't one. Only steps with pattern set are
+// pattern steps: otherwise % is just part of a file name.
+func patternInput(step *BuildStep) int {
+	for i, in := range step.Inputs {
+		if strings.Contains(in, PatternStem) {
+			return i
+		}
+	}
+	return -1
+}
+
+// expandPattern returns one step per file matching the step's pattern input.
+// The pattern input is expanded with the step's vars and then % is matched
+// like the glob *. The text matched by % is the "stem": it replaces % in all
+// the other inputs, outputs, and clean entries and is available as the var
+// DMK_STEM. E.g. a step named clean with the input raw/%.csv and the output
+// clean/%.parquet becomes a step named clean.a with the input raw/a.csv and
+// the output clean/a.parquet for the file raw/a.csv
+func expandPattern(step *BuildStep) ([]*BuildStep, error) {
+	idx := patternInput(step)
+	if idx < 0 {
+		return nil, fmt.Errorf("%s: a pattern step needs an input containing %s", step.Name, PatternStem)
+	}
+	// Glob drops a leading ./ (among other things) from its matches, so the
+	// pattern must be clean for the prefix to match
+	pattern := filepath.Clean(os.Expand(step.Inputs[idx], varMapping(step)))
+
+	if strings.Count(pattern, PatternStem) != 1 {
+		return nil, fmt.Errorf("%s: pattern %s must contain exactly one %s", step.Name, pattern, PatternStem)
+	}
+	stemAt := strings.Index(pattern, PatternStem)
+	prefix, suffix := pattern[:stemAt], pattern[stemAt+1:]
+	if strings.ContainsAny(prefix+suffix, "*?[]") {
+		return nil, fmt.Errorf("%s: pattern %s may not use other glob characters", step.Name, pattern)
+	}
+
+	matches, err := MultiGlob([]string{prefix + "*" + suffix})
+	if err != nil {
+		return nil, err
+	}
+
+	generated := make([]*BuildStep, 0, len(matches))
+	for _, match := range matches {
+		if !strings.HasPrefix(match, prefix) || !strings.HasSuffix(match, suffix) ||
+			len(match) < len(prefix)+len(suffix) {
+			return nil, fmt.Errorf("%s: %s does not match the pattern %s", step.Name, match, pattern)
+		}
+		stem := match[len(prefix) : len(match)-len(suffix)]
+		if len(stem) < 1 {
+			continue // Like make, we don't allow empty stems
+		}
+
+		g := copyStep(step)
+		g.Name = step.Name + "." + stem
+		if len(step.Origin) > 0 {
+			g.ancestors = append(g.ancestors, step.Origin)
+		}
+		g.Origin = step.Name
+		g.Pattern = false
+		g.Vars["DMK_STEM"] = stem
+
+		replaceStem(g.Inputs, stem)
+		g.Inputs[idx] = match
+		replaceStem(g.Outputs, stem)
+		replaceStem(g.Clean, stem)
+
+		generated = append(generated, g)
+	}
+
+	// Almost certainly a mistake (or files that haven't been made yet), and
+	// the step would silently disappear
+	if len(generated) < 1 {
+		return nil, fmt.Errorf("%s: pattern %s matched no files", step.Name, pattern)
+	}
+
+	return generated, nil
+}
+
+// replaceStem replaces the stem character in every entry of the list
+func replaceStem(entries []string, stem string) {
+	for i, e := range entries {
+		entries[i] = strings.Replace(e, PatternStem, stem, -1)
+	}
+}
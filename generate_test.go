@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatrixSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/matrix.yaml")
+	pcheck(err)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Len(cfg, 7) // prep + 2*3 variants
+
+	variants := []string{
+		"train.iris.rf", "train.iris.svm", "train.iris.xgb",
+		"train.wine.rf", "train.wine.svm", "train.wine.xgb",
+	}
+
+	for _, name := range variants {
+		assert.Contains(cfg, name)
+		assert.Equal("train", cfg[name].Origin)
+		assert.Nil(cfg[name].Matrix)
+	}
+
+	step := cfg["train.wine.xgb"]
+	assert.Equal("train.wine.xgb", step.Name)
+	assert.Equal("echo wine xgb | tee train.wine.xgb.txt", step.Command)
+	assert.Equal([]string{"data/wine.csv", "prep.txt"}, step.Inputs)
+	assert.Equal([]string{"models/wine-xgb.txt"}, step.Outputs)
+	assert.Equal("wine", step.Vars["dataset"])
+	assert.Equal("xgb", step.Vars["model"])
+
+	// Variants can be targeted individually or all at once
+	assertSteps(assert, cfg, []string{"train.iris.rf"}, "prep", "train.iris.rf")
+	assertSteps(assert, cfg, []string{"train"}, append([]string{"prep"}, variants...)...)
+
+	// A matrix key needs values
+	_, err = ReadConfig([]byte("a: {outputs: [a.txt], matrix: {x: []}}"))
+	assert.Error(err)
+
+	// Generated names may not collide
+	_, err = ReadConfig([]byte("a: {outputs: [a.txt], matrix: {x: [y]}}\na.y: {outputs: [b.txt]}"))
+	assert.Error(err)
+}
+
+func TestPatternSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/pattern.yaml")
+	pcheck(err)
+
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+	prevDir, err := os.Getwd()
+	pcheck(err)
+	pcheck(os.Chdir(dir))
+	defer func() {
+		assert.NoError(os.Chdir(prevDir))
+	}()
+
+	pcheck(os.Mkdir("raw", 0755))
+	for _, f := range []string{"raw/a.csv", "raw/b.csv", "raw/.csv", "raw/skip.txt"} {
+		pcheck(ioutil.WriteFile(f, []byte("data"), 0644))
+	}
+
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Len(cfg, 3) // summary + one per non-empty stem
+
+	step := cfg["clean.a"]
+	assert.NotNil(step)
+	assert.Equal("clean", step.Origin)
+	assert.Equal("sort raw/a.csv > clean/a.txt", step.Command)
+	assert.Equal([]string{"raw/a.csv", "sort-opts.txt"}, step.Inputs)
+	assert.Equal([]string{"clean/a.txt"}, step.Outputs)
+	assert.Equal([]string{"clean/a.log"}, step.Clean)
+	assert.Equal("a", step.Vars["DMK_STEM"])
+
+	assert.Contains(cfg, "clean.b")
+	assertSteps(assert, cfg, []string{"summary"}, "clean.a", "clean.b", "summary")
+	assertSteps(assert, cfg, []string{"clean"}, "clean.a", "clean.b")
+
+	// A leading ./ is the same pattern
+	cfg, err = ReadConfig([]byte("c:\n    command: cat $DMK_STEM\n    pattern: true\n    inputs: ['./raw/%.csv']\n    outputs: ['out/%.txt']\n"))
+	assert.NoError(err)
+	assertSteps(assert, cfg, []string{"c"}, "c.a", "c.b")
+	assert.Equal([]string{"raw/a.csv"}, cfg["c.a"].Inputs)
+	assert.Equal([]string{"out/a.txt"}, cfg["c.a"].Outputs)
+
+	// Pattern steps from matrix variants can be targeted by the variant name
+	// or the matrix step's name
+	pcheck(os.MkdirAll("data/iris", 0755))
+	pcheck(os.MkdirAll("data/wine", 0755))
+	for _, f := range []string{"data/iris/a.csv", "data/iris/b.csv", "data/wine/a.csv"} {
+		pcheck(ioutil.WriteFile(f, []byte("data"), 0644))
+	}
+	cfg, err = ReadConfig([]byte(`
+train:
+    command: cat $DMK_STEM
+    pattern: true
+    inputs: ['data/${dataset}/%.csv']
+    outputs: ['models/${dataset}/%.txt']
+    matrix:
+        dataset: [iris, wine]
+`))
+	assert.NoError(err)
+	assert.Equal("train.iris", cfg["train.iris.a"].Origin)
+	assert.True(cfg["train.iris.a"].GeneratedFrom("train"))
+	assert.False(cfg["train.iris.a"].GeneratedFrom("train.wine"))
+	assertSteps(assert, cfg, []string{"train.iris"}, "train.iris.a", "train.iris.b")
+	assertSteps(assert, cfg, []string{"train.wine.a"}, "train.wine.a")
+	assertSteps(assert, cfg, []string{"train"}, "train.iris.a", "train.iris.b", "train.wine.a")
+
+	// Without pattern, % is just part of a file name
+	cfg, err = ReadConfig([]byte("a: {inputs: ['data%20file.csv'], outputs: ['a%.txt']}"))
+	assert.NoError(err)
+	assert.Len(cfg, 1)
+	assert.Equal([]string{"data%20file.csv"}, cfg["a"].Inputs)
+
+	// Only one stem, no other globbing in the pattern, and something must
+	// match
+	_, err = ReadConfig([]byte("a: {pattern: true, inputs: ['%/%.csv'], outputs: [a.txt]}"))
+	assert.Error(err)
+	_, err = ReadConfig([]byte("a: {pattern: true, inputs: ['*/%.csv'], outputs: [a.txt]}"))
+	assert.Error(err)
+	_, err = ReadConfig([]byte("a: {pattern: true, inputs: ['raw/%.json'], outputs: [a.txt]}"))
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "matched no files")
+	}
+	_, err = ReadConfig([]byte("a: {pattern: true, inputs: ['raw/a.csv'], outputs: [a.txt]}"))
+	assert.Error(err)
+}
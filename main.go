@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -21,9 +22,26 @@ func main() {
 	flags := flag.NewFlagSet("dmk", flag.ExitOnError)
 	pipelineFileSpec := flags.String("f", "", "Pipeline file name (can be - for stdin)")
 	cleanSpec := flags.Bool("c", false, "Clean instead of build")
+	explainSpec := flags.String("explain", "", "Explain why the step would (or would not) run instead of build")
+	touchSpec := flags.Bool("touch", false, "Mark outputs up to date instead of build")
 	verboseSpec := flags.Bool("v", false, "verbose output")
 	envSpec := flags.String("e", "", "Environment file")
 	listStepsSpec := flags.Bool("listSteps", false, "list all steps and exit. No other actions will be taken")
+	varSpec := VarFlags{}
+	flags.Var(varSpec, "var", "KEY=VALUE variable overriding step vars (may be repeated)")
+	tagSpec := ListFlags{}
+	flags.Var(&tagSpec, "tag", "select steps with this tag (may be repeated)")
+	excludeSpec := ListFlags{}
+	flags.Var(&excludeSpec, "exclude", "skip this step and the dependencies only it needs (may be repeated)")
+	forceSpec := ListFlags{}
+	flags.Var(&forceSpec, "force", "force this step and every step downstream of it to run (may be repeated)")
+	fromSpec := ListFlags{}
+	flags.Var(&fromSpec, "from", "select and force this step and every step downstream of it (may be repeated)")
+	var alwaysSpec bool
+	flags.BoolVar(&alwaysSpec, "B", false, "run every selected step, even if it is up to date")
+	flags.BoolVar(&alwaysSpec, "always", false, "same as -B")
+	traceSpec := flags.Bool("trace", false, "trace the files each command uses and report undeclared inputs and outputs")
+	noDepsSpec := flags.Bool("nodeps", false, "run the selected steps without their dependencies")
 
 	pcheck(flags.Parse(os.Args[1:]))
 
@@ -31,6 +49,13 @@ func main() {
 	verbose := *verboseSpec
 	args := flags.Args()
 	listSteps := *listStepsSpec
+	selector := StepSelector{
+		Names:   args,
+		Tags:    tagSpec,
+		From:    fromSpec,
+		Exclude: excludeSpec,
+		NoDeps:  *noDepsSpec,
+	}
 
 	if !listSteps {
 		log.Printf("dmk %s\n", Version())
@@ -63,8 +88,17 @@ func main() {
 
 	verb.Printf("Verbose mode: ON\n")
 	verb.Printf("Clean: %v\n", clean)
+	verb.Printf("Touch: %v\n", *touchSpec)
+	verb.Printf("Explain: %s\n", *explainSpec)
 	verb.Printf("Pipeline File: %s\n", pipelineFile)
 	verb.Printf("List Steps: %v\n", listSteps)
+	verb.Printf("Tags: %v\n", &tagSpec)
+	verb.Printf("Exclude: %v\n", &excludeSpec)
+	verb.Printf("Force: %v\n", &forceSpec)
+	verb.Printf("From: %v\n", &fromSpec)
+	verb.Printf("Always: %v\n", alwaysSpec)
+	verb.Printf("Trace: %v\n", *traceSpec)
+	verb.Printf("No Deps: %v\n", selector.NoDeps)
 
 	// Import environment variables from envFile if specified
 	if envSpec != nil && *envSpec != "" {
@@ -111,15 +145,24 @@ func main() {
 	}
 
 	// Parse the config file
-	cfg, err := ReadConfig(cfgText)
+	cfg, err := ReadConfigVars(cfgText, varSpec)
 	pcheck(err)
 	verb.Printf("Found %d build steps", len(cfg))
+	verb.Printf("Override Vars: %v\n", maskSecretVars(cfg, varSpec))
+
+	// Mark stale steps before trimming: we want everything downstream
+	if len(forceSpec)+len(fromSpec) > 0 {
+		forced, err := ForceSteps(cfg, append(append([]string{}, forceSpec...), fromSpec...))
+		pcheck(err)
+		verb.Printf("Forcing %d steps: %v\n", len(forced), forced)
+	}
 
 	// Figure out the steps that need to run
+	allSteps := cfg
 	var newCfg ConfigFile
-	if len(args) > 0 {
-		verb.Printf("Steps specified on command line: trimming for %v\n", args)
-		newCfg, err = TrimSteps(cfg, args)
+	if !selector.IsEmpty() {
+		verb.Printf("Steps selected on command line: trimming for %+v\n", selector)
+		newCfg, err = SelectSteps(cfg, selector)
 		pcheck(err)
 		cfg = newCfg
 		verb.Printf("%d build steps remaining", len(cfg))
@@ -132,12 +175,23 @@ func main() {
 	}
 	// No else: listSteps will include explicit steps
 
+	if alwaysSpec {
+		AlwaysRun(cfg)
+	}
+	if *traceSpec {
+		TraceAll(cfg)
+	}
+
 	// Do what we're supposed to do
 	var exitCode int
 	if listSteps {
 		exitCode = DoListSteps(cfg, verb)
+	} else if *explainSpec != "" {
+		exitCode = DoExplain(allSteps, *explainSpec, verb)
 	} else if clean {
 		exitCode = DoClean(cfg, verb)
+	} else if *touchSpec {
+		exitCode = DoTouch(cfg, verb)
 	} else {
 		exitCode = DoBuild(cfg, verb)
 	}
@@ -145,18 +199,52 @@ func main() {
 	os.Exit(exitCode)
 }
 
-// DoListSteps just outputs all step names
+// maskSecretVars returns a copy of the override vars where any var that is a
+// secret for some step is masked
+func maskSecretVars(cfg ConfigFile, vars VarFlags) VarFlags {
+	masked := VarFlags{}
+	for k, v := range vars {
+		masked[k] = v
+		for _, step := range cfg {
+			if step.IsSecret(k) {
+				masked[k] = SecretMask
+				break
+			}
+		}
+	}
+	return masked
+}
+
+// DoListSteps just outputs all step names (and the names of steps that
+// generated other steps, since they may also be specified)
 func DoListSteps(cfg ConfigFile, verb *log.Logger) int {
+	names := NewUniqueStrings()
+	for _, step := range cfg {
+		names.Add(step.Name)
+		if len(step.Origin) > 0 {
+			names.Add(step.Origin)
+		}
+		for _, a := range step.ancestors {
+			names.Add(a)
+		}
+	}
+
 	// We must write to stdout, so we always create our own logger
 	stepLog := log.New(os.Stdout, "", 0)
-	for _, step := range cfg {
-		stepLog.Printf("%s\n", step.Name)
+	for _, name := range names.Strings() {
+		stepLog.Printf("%s\n", name)
 	}
 	return 0
 }
 
 // DoClean cleans all files specified by the config file
 func DoClean(cfg ConfigFile, verb *log.Logger) int {
+	state, err := LoadState(StateFileName)
+	if err != nil {
+		log.Printf("Could not read state file %s: %v\n", StateFileName, err)
+		return 1
+	}
+
 	targets := NewUniqueStrings()
 
 	for _, step := range cfg {
@@ -166,6 +254,17 @@ func DoClean(cfg ConfigFile, verb *log.Logger) int {
 		for _, file := range step.Clean {
 			targets.Add(file)
 		}
+
+		// Output globs (current matches and anything found by a build)
+		outputs, err := OutputFiles(step, state)
+		if err != nil {
+			log.Printf("%s: could not find outputs: %v\n", step.Name, err)
+			return 1
+		}
+		for _, file := range outputs {
+			targets.Add(file)
+		}
+		state.Forget(step.Name)
 	}
 
 	targetFiles := targets.Strings()
@@ -173,6 +272,9 @@ func DoClean(cfg ConfigFile, verb *log.Logger) int {
 
 	failCount := 0
 	for _, file := range targetFiles {
+		if IsGlob(file) {
+			continue // Files matching output globs are already targets
+		}
 		log.Printf("CLEAN: %s\n", file)
 		err := os.RemoveAll(file)
 		if err != nil && !os.IsNotExist(err) {
@@ -181,6 +283,99 @@ func DoClean(cfg ConfigFile, verb *log.Logger) int {
 		}
 	}
 
+	if err := state.Save(); err != nil {
+		log.Printf("Could not save state file %s: %v\n", StateFileName, err)
+		failCount++
+	}
+
+	return failCount
+}
+
+// DoExplain describes why the named step (or steps, for a group or pattern)
+// would or would not run. Every step is given so that we can find the steps
+// producing the inputs.
+func DoExplain(cfg ConfigFile, name string, verb *log.Logger) int {
+	names, err := ResolveStepNames(cfg, []string{name})
+	if err != nil {
+		log.Printf("%v\n", err)
+		return 1
+	}
+
+	state, err := LoadState(StateFileName)
+	if err != nil {
+		log.Printf("Could not read state file %s: %v\n", StateFileName, err)
+		return 1
+	}
+
+	// We must write to stdout, so we always create our own logger
+	out := log.New(os.Stdout, "", 0)
+	failCount := 0
+	for idx, name := range names {
+		if idx > 0 {
+			out.Printf("\n")
+		}
+		inst := NewBuildStepInst(cfg[name], nil, verb, nil, state)
+		if err := inst.Explain(cfg, out); err != nil {
+			log.Printf("%s: could not explain - %v\n", name, err)
+			failCount++
+		}
+	}
+	return failCount
+}
+
+// DoTouch updates the outputs of every step (in dependency order) so that
+// they are all up to date, without running any commands. Nothing is changed
+// if any outputs are missing.
+func DoTouch(cfg ConfigFile, verb *log.Logger) int {
+	order, err := TopoSort(cfg)
+	if err != nil {
+		log.Printf("Could not order steps: %v\n", err)
+		return 1
+	}
+
+	state, err := LoadState(StateFileName)
+	if err != nil {
+		log.Printf("Could not read state file %s: %v\n", StateFileName, err)
+		return 1
+	}
+
+	insts := make([]*BuildStepInstance, 0, len(order))
+	for _, name := range order {
+		step := cfg[name]
+		if step.Phony {
+			continue // Nothing to touch
+		}
+		insts = append(insts, NewBuildStepInst(step, nil, verb, nil, state))
+	}
+
+	// Make sure everything exists before we change anything
+	failCount := 0
+	for _, inst := range insts {
+		if err := inst.CheckOutputs(); err != nil {
+			log.Printf("%s: cannot touch - %v\n", inst.Step.Name, err)
+			failCount++
+		}
+	}
+	if failCount > 0 {
+		log.Printf("\n*** FAILURE!!!\n*** Nothing touched: %d steps are missing outputs\n", failCount)
+		return failCount
+	}
+
+	now := time.Now()
+	for _, inst := range insts {
+		if err := inst.Touch(now); err != nil {
+			log.Printf("%s: FAIL - %v\n", inst.Step.Name, err)
+			failCount++
+			continue
+		}
+		log.Printf("TOUCH: %s\n", inst.Step.Name)
+	}
+
+	if err := state.Save(); err != nil {
+		log.Printf("Could not save state file %s: %v\n", StateFileName, err)
+		failCount++
+	}
+
 	return failCount
 }
 
@@ -195,6 +390,20 @@ func DoBuild(cfg ConfigFile, verb *log.Logger) int {
 	}
 	verb.Printf("BUILD: total possible outputs = %d\n", len(targets.Seen))
 
+	// A loop (like an input glob matching a downstream step's output) would
+	// leave every step in it waiting forever
+	if _, err := TopoSort(cfg); err != nil {
+		log.Printf("Could not order steps: %v\n", err)
+		return 1
+	}
+
+	// Load everything we remember from previous builds
+	state, err := LoadState(StateFileName)
+	if err != nil {
+		log.Printf("Could not read state file %s: %v\n", StateFileName, err)
+		return 1
+	}
+
 	// We need a broadcaster for dependency notifications
 	broad := NewBroadcaster()
 	pcheck(broad.Start())
@@ -204,10 +413,15 @@ func DoBuild(cfg ConfigFile, verb *log.Logger) int {
 	wg := sync.WaitGroup{}
 
 	for _, step := range cfg {
-		verb.Printf("Starting step %s\n", step.Name)
+		if step.IsGroup() {
+			continue // Groups are never executed
+		}
+		running = append(running, NewBuildStepInst(step, targets.Seen, verb, broad, state))
+	}
 
-		one := NewBuildStepInst(step, targets.Seen, verb, broad)
-		running = append(running, one)
+	for _, one := range running {
+		verb.Printf("Starting step %s\n", one.Step.Name)
+		one.Link(running)
 
 		wg.Add(1)
 		go func(inst *BuildStepInstance) {
@@ -221,7 +435,7 @@ func DoBuild(cfg ConfigFile, verb *log.Logger) int {
 
 	// Wait for them to complete
 	wg.Wait()
-	err := broad.Kill()
+	err = broad.Kill()
 	if err != nil {
 		verb.Printf("COuld not kill broadcaster: %v\n", err)
 	}
@@ -245,6 +459,11 @@ func DoBuild(cfg ConfigFile, verb *log.Logger) int {
 		failCount = failCount + successCount + 1
 	}
 
+	if err := state.Save(); err != nil {
+		log.Printf("Could not save state file %s: %v\n", StateFileName, err)
+		failCount++
+	}
+
 	if failCount > 0 {
 		log.Printf("\n*** FAILURE!!!\n*** Count is %v\n", failCount)
 		for _, failName := range failDetail {
@@ -260,7 +479,14 @@ func DeleteFailed(step *BuildStep) {
 	if !step.DelOnFail {
 		return
 	}
-	for _, f := range step.Outputs {
+	globbed, err := OutputFiles(step, nil)
+	if err != nil {
+		log.Printf("%s: could not find outputs to delete: %s\n", step.Name, err.Error())
+	}
+	for _, f := range append(append([]string{}, step.Outputs...), globbed...) {
+		if IsGlob(f) {
+			continue // Deleted via the files it matched
+		}
 		err := os.RemoveAll(f)
 		if err == nil || !os.IsNotExist(err) {
 			log.Printf("%s: deleted %s\n", step.Name, f)
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultShell runs commands when a step doesn't specify a shell
+const DefaultShell = "/bin/bash"
+
+// NoShell is the shell name meaning a command is run directly: it is split
+// into words on white space and the first word is the program to run
+const NoShell = "none"
+
+// shellFlags are the flags telling known shells and interpreters that the
+// next argument is the code to run
+var shellFlags = map[string]string{
+	"bash":    "-c",
+	"dash":    "-c",
+	"ksh":     "-c",
+	"sh":      "-c",
+	"zsh":     "-c",
+	"python":  "-c",
+	"python2": "-c",
+	"python3": "-c",
+	"perl":    "-e",
+	"ruby":    "-e",
+	"node":    "-e",
+	"Rscript": "-e",
+}
+
+// Shell is the program used to run a step's command. In the pipeline file it
+// may be the name of a known shell or interpreter (like sh or python3), the
+// name "none" for running the command without a shell, or a list of
+// arguments (like [python3, -u, -c]) that the command is added to.
+type Shell []string
+
+// UnmarshalYAML accepts either a single name or a list
+func (sh *Shell) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*sh = Shell{name}
+		return nil
+	}
+
+	var argv []string
+	if err := unmarshal(&argv); err != nil {
+		return err
+	}
+	*sh = Shell(argv)
+	return nil
+}
+
+// String returns the shell as it would be written on a command line
+func (sh Shell) String() string {
+	if len(sh) < 1 {
+		return DefaultShell
+	}
+	return strings.Join(sh, " ")
+}
+
+// Check returns an error if the shell can't be used
+func (sh Shell) Check() error {
+	if len(sh) == 1 && sh[0] != NoShell {
+		if _, ok := shellFlags[filepath.Base(sh[0])]; !ok {
+			return fmt.Errorf("Unknown shell %s: use a list like [%s, -c] instead", sh[0], sh[0])
+		}
+	}
+	for _, arg := range sh {
+		if len(strings.TrimSpace(arg)) < 1 {
+			return fmt.Errorf("Shell %v has an empty argument", []string(sh))
+		}
+	}
+	return nil
+}
+
+// Argv returns the program and arguments that run the command
+func (sh Shell) Argv(command string) ([]string, error) {
+	if err := sh.Check(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(sh) < 1:
+		return []string{DefaultShell, "-c", command}, nil
+	case len(sh) == 1 && sh[0] == NoShell:
+		words := strings.Fields(command)
+		if len(words) < 1 {
+			return nil, fmt.Errorf("Nothing to run without a shell")
+		}
+		return words, nil
+	case len(sh) == 1:
+		return []string{sh[0], shellFlags[filepath.Base(sh[0])], command}, nil
+	default:
+		return append(append([]string{}, sh...), command), nil
+	}
+}
+
+// SpliceInputs and SpliceOutputs are the arguments in a list command that
+// are replaced by the step's inputs and outputs (as separate arguments)
+const (
+	SpliceInputs  = "@inputs"
+	SpliceOutputs = "@outputs"
+)
+
+// SpliceArgs returns the arguments of a list command with SpliceInputs and
+// SpliceOutputs replaced by the files given
+func SpliceArgs(args []string, inputs []string, outputs []string) []string {
+	argv := make([]string, 0, len(args)+len(inputs)+len(outputs))
+	for _, arg := range args {
+		switch arg {
+		case SpliceInputs:
+			argv = append(argv, inputs...)
+		case SpliceOutputs:
+			argv = append(argv, outputs...)
+		default:
+			argv = append(argv, arg)
+		}
+	}
+	return argv
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestShell(t *testing.T) {
+	assert := assert.New(t)
+
+	argv := func(sh Shell, cmd string) []string {
+		a, err := sh.Argv(cmd)
+		assert.NoError(err)
+		return a
+	}
+
+	assert.Equal([]string{"/bin/bash", "-c", "echo hi"}, argv(nil, "echo hi"))
+	assert.Equal([]string{"sh", "-c", "echo hi"}, argv(Shell{"sh"}, "echo hi"))
+	assert.Equal([]string{"python3", "-c", "print(1)"}, argv(Shell{"python3"}, "print(1)"))
+	assert.Equal([]string{"/usr/bin/Rscript", "-e", "1+1"}, argv(Shell{"/usr/bin/Rscript"}, "1+1"))
+	assert.Equal([]string{"python3", "-u", "-c", "x"}, argv(Shell{"python3", "-u", "-c"}, "x"))
+	assert.Equal([]string{"cp", "a", "c"}, argv(Shell{"none"}, "  cp a\n c "))
+
+	assert.Equal("/bin/bash", Shell{}.String())
+	assert.Equal("python3 -u -c", Shell{"python3", "-u", "-c"}.String())
+
+	_, err := Shell{"mystery"}.Argv("x")
+	assert.Error(err)
+	_, err = Shell{"none"}.Argv("  ")
+	assert.Error(err)
+	_, err = Shell{"python3", ""}.Argv("x")
+	assert.Error(err)
+
+	// Either form can be read
+	var parsed struct {
+		A Shell `yaml:"a"`
+		B Shell `yaml:"b"`
+	}
+	assert.NoError(yaml.Unmarshal([]byte("a: python3\nb: [Rscript, --vanilla, -e]\n"), &parsed))
+	assert.Equal(Shell{"python3"}, parsed.A)
+	assert.Equal(Shell{"Rscript", "--vanilla", "-e"}, parsed.B)
+	assert.Error(yaml.Unmarshal([]byte("a: {x: y}\n"), &parsed))
+}
+
+func TestSpliceArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	args := []string{"cmd", "@inputs", "-o", "@outputs", "@input"}
+	assert.Equal(
+		[]string{"cmd", "a b", "c", "-o", "out", "@input"},
+		SpliceArgs(args, []string{"a b", "c"}, []string{"out"}),
+	)
+	assert.Equal([]string{"cmd", "-o", "@input"}, SpliceArgs(args, nil, nil))
+}
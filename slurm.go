@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlurmExecutorName is the name of the executor that runs commands as SLURM
+// batch jobs
+const SlurmExecutorName = "slurm"
+
+// SlurmJobDir is the directory (in the pipeline directory) holding the job
+// script, output, and exit code for each step run as a batch job. It must be
+// on a file system shared with the cluster's nodes.
+const SlurmJobDir = ".dmk-slurm"
+
+// SlurmInvalidJob is in the error from squeue when it no longer knows a job
+const SlurmInvalidJob = "Invalid job id specified"
+
+// StepResources are what a step asks the batch scheduler for. Anything left
+// out uses the cluster's defaults.
+type StepResources struct {
+	CPUs      int      `yaml:"cpus"`
+	Memory    string   `yaml:"memory"` // Like 4G
+	Time      string   `yaml:"time"`   // Like 1:30:00
+	GPUs      int      `yaml:"gpus"`
+	Partition string   `yaml:"partition"`
+	Options   []string `yaml:"options"` // Any other sbatch options
+}
+
+// merge fills in anything missing from a base step or the global section
+func (sr *StepResources) merge(from StepResources) {
+	if sr.CPUs == 0 {
+		sr.CPUs = from.CPUs
+	}
+	if len(sr.Memory) < 1 {
+		sr.Memory = from.Memory
+	}
+	if len(sr.Time) < 1 {
+		sr.Time = from.Time
+	}
+	if sr.GPUs == 0 {
+		sr.GPUs = from.GPUs
+	}
+	if len(sr.Partition) < 1 {
+		sr.Partition = from.Partition
+	}
+	sr.Options = append(sr.Options, from.Options...)
+}
+
+// SbatchOptions returns the sbatch options for the resources
+func (sr StepResources) SbatchOptions() []string {
+	opts := []string{}
+	if sr.CPUs > 0 {
+		opts = append(opts, fmt.Sprintf("--cpus-per-task=%d", sr.CPUs))
+	}
+	if len(sr.Memory) > 0 {
+		opts = append(opts, "--mem="+sr.Memory)
+	}
+	if len(sr.Time) > 0 {
+		opts = append(opts, "--time="+sr.Time)
+	}
+	if sr.GPUs > 0 {
+		opts = append(opts, fmt.Sprintf("--gres=gpu:%d", sr.GPUs))
+	}
+	if len(sr.Partition) > 0 {
+		opts = append(opts, "--partition="+sr.Partition)
+	}
+	return append(opts, sr.Options...)
+}
+
+// SlurmBuildState maps a SLURM job state (as shown by squeue) to the state
+// of the build step. Jobs waiting or running are still executing.
+func SlurmBuildState(jobState string) int {
+	fields := strings.Fields(jobState) // Like "CANCELLED by 1234"
+	if len(fields) < 1 {
+		return buildExecuting
+	}
+	switch strings.TrimSuffix(fields[0], "+") {
+	case "COMPLETED":
+		return buildCompleted
+	case "BOOT_FAIL", "CANCELLED", "DEADLINE", "FAILED", "NODE_FAIL",
+		"OUT_OF_MEMORY", "PREEMPTED", "REVOKED", "TIMEOUT":
+		return buildFailed
+	default:
+		return buildExecuting // PENDING, RUNNING, COMPLETING, etc
+	}
+}
+
+// SlurmExecutor submits the command as a batch job with Sbatch and then
+// checks on it with Squeue every Poll until it is done. Output and the exit
+// code are written to files in SlurmJobDir, so the pipeline directory must
+// be shared with the cluster's nodes.
+type SlurmExecutor struct {
+	Sbatch string
+	Squeue string
+	Poll   time.Duration
+}
+
+// unsafeJobChars are replaced in step names to make directory names
+var unsafeJobChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// JobDir returns the directory for the step's job files
+func (sx SlurmExecutor) JobDir(step *BuildStep) string {
+	return filepath.Join(SlurmJobDir, unsafeJobChars.ReplaceAllString(step.Name, "_"))
+}
+
+// JobScript returns the batch script that runs the job. dir is the absolute
+// job directory. The environment isn't in the script: see Execute.
+func (sx SlurmExecutor) JobScript(job Job, dir string) (string, error) {
+	workdir, err := filepath.Abs(job.Step.Workdir)
+	if err != nil {
+		return "", err
+	}
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "#!/bin/bash\n")
+	fmt.Fprintf(&script, "#SBATCH --job-name=dmk-%s\n", unsafeJobChars.ReplaceAllString(job.Step.Name, "_"))
+	fmt.Fprintf(&script, "#SBATCH --output=%s\n", filepath.Join(dir, "stdout.txt"))
+	fmt.Fprintf(&script, "#SBATCH --error=%s\n", filepath.Join(dir, "stderr.txt"))
+	for _, opt := range job.Step.Resources.SbatchOptions() {
+		fmt.Fprintf(&script, "#SBATCH %s\n", opt)
+	}
+
+	fmt.Fprintf(&script, "cd %s || exit 1\n", ShellQuote(workdir))
+	words := make([]string, 0, len(job.Argv))
+	for _, arg := range job.Argv {
+		words = append(words, ShellQuote(arg))
+	}
+	fmt.Fprintf(&script, "%s\n", strings.Join(words, " "))
+	fmt.Fprintf(&script, "echo $? > %s\n", ShellQuote(filepath.Join(dir, "exitcode")))
+	return script.String(), nil
+}
+
+// Execute submits the job and waits for it to finish
+func (sx SlurmExecutor) Execute(job Job) error {
+	dir, err := filepath.Abs(sx.JobDir(job.Step))
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	script, err := sx.JobScript(job, dir)
+	if err != nil {
+		return err
+	}
+	scriptFile := filepath.Join(dir, "job.sh")
+	if err := ioutil.WriteFile(scriptFile, []byte(script), 0600); err != nil {
+		return err
+	}
+
+	// The job gets the environment sbatch runs with, so that values (like
+	// secrets) are never written to the job script or put on a command line.
+	// The environment is set as for the other remote executors (see
+	// remoteEnv), on top of our own.
+	cmd := exec.Command(sx.Sbatch, "--parsable", "--export=ALL", scriptFile)
+	cmd.Env = append(os.Environ(), remoteEnv(job.Env, job.Tracked)...)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", sx.Sbatch, err)
+	}
+	// --parsable prints the id, or id;cluster
+	jobID := strings.SplitN(strings.TrimSpace(string(out)), ";", 2)[0]
+	if len(jobID) < 1 {
+		return fmt.Errorf("%s did not print a job id", sx.Sbatch)
+	}
+	job.Verb.Printf("%s: submitted job %s\n", job.Step.Name, jobID)
+
+	waitErr := sx.wait(job, jobID)
+
+	// Whatever happened, the job's output is ours
+	if err := copyFile(filepath.Join(dir, "stdout.txt"), job.Stdout); err != nil {
+		return err
+	}
+	if err := copyFile(filepath.Join(dir, "stderr.txt"), job.Stderr); err != nil {
+		return err
+	}
+	if waitErr != nil {
+		return waitErr
+	}
+
+	// The job leaves the queue however it ends, so the exit code is how we
+	// know the command finished
+	code, err := ioutil.ReadFile(filepath.Join(dir, "exitcode"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Job %s ended without finishing the command (cancelled or out of time?)", jobID)
+	} else if err != nil {
+		return err
+	}
+	exitCode, err := strconv.Atoi(strings.TrimSpace(string(code)))
+	if err != nil {
+		return fmt.Errorf("Job %s has a bad exit code: %v", jobID, err)
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("Job %s exited with %d", jobID, exitCode)
+	}
+	return nil
+}
+
+// wait polls until the job leaves the queue or fails
+func (sx SlurmExecutor) wait(job Job, jobID string) error {
+	last := ""
+	for {
+		var stderr bytes.Buffer
+		cmd := exec.Command(sx.Squeue, "--noheader", "--jobs="+jobID, "--format=%T")
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			// Finished jobs are purged from the controller after a while, so
+			// asking about one we missed is an error: Execute checks how it
+			// ended with the exit code file
+			if strings.Contains(stderr.String(), SlurmInvalidJob) {
+				return nil
+			}
+			return fmt.Errorf("%s failed for job %s: %v: %s", sx.Squeue, jobID, err, strings.TrimSpace(stderr.String()))
+		}
+		jobState := strings.TrimSpace(string(out))
+		if len(jobState) < 1 {
+			return nil // No longer queued
+		}
+		if jobState != last {
+			job.Verb.Printf("%s: job %s is %s\n", job.Step.Name, jobID, jobState)
+			last = jobState
+		}
+
+		switch SlurmBuildState(jobState) {
+		case buildFailed:
+			return fmt.Errorf("Job %s is %s", jobID, jobState)
+		case buildCompleted:
+			return nil
+		}
+		time.Sleep(sx.Poll)
+	}
+}
+
+// copyFile copies the file to w. A missing file is empty.
+func copyFile(file string, w io.Writer) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
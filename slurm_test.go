@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepResources(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Len(StepResources{}.SbatchOptions(), 0)
+
+	res := StepResources{CPUs: 4, Memory: "8G", Options: []string{"--qos=low"}}
+	res.merge(StepResources{CPUs: 2, Time: "1:00:00", GPUs: 1, Partition: "gpu", Options: []string{"--account=lab"}})
+	assert.Equal([]string{
+		"--cpus-per-task=4",
+		"--mem=8G",
+		"--time=1:00:00",
+		"--gres=gpu:1",
+		"--partition=gpu",
+		"--qos=low",
+		"--account=lab",
+	}, res.SbatchOptions())
+}
+
+func TestSlurmBuildState(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, state := range []string{"PENDING", "RUNNING", "COMPLETING", "CONFIGURING", "SUSPENDED", ""} {
+		assert.Equal(buildExecuting, SlurmBuildState(state), state)
+	}
+	assert.Equal(buildCompleted, SlurmBuildState("COMPLETED"))
+	for _, state := range []string{"FAILED", "CANCELLED by 1234", "CANCELLED+", "TIMEOUT", "OUT_OF_MEMORY", "NODE_FAIL"} {
+		assert.Equal(buildFailed, SlurmBuildState(state), state)
+	}
+}
+
+func TestSlurmJobScript(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := os.Getwd()
+	pcheck(err)
+
+	sx := SlurmExecutor{}
+	step := &BuildStep{
+		Name:      "train/a b",
+		Workdir:   "res",
+		Resources: StepResources{CPUs: 2, Partition: "short"},
+	}
+	assert.Equal(filepath.Join(SlurmJobDir, "train_a_b"), sx.JobDir(step))
+
+	script, err := sx.JobScript(Job{
+		Step:    step,
+		Argv:    []string{"/bin/bash", "-c", "python3 train.py > model.txt"},
+		Env:     []string{"DMK_STEPNAME=train", "HOME=/home/me", "MODEL=xgb"},
+		Tracked: map[string]string{"MODEL": "xgb"},
+		Verb:    log.New(ioutil.Discard, "", 0),
+	}, "/jobs/train")
+	assert.NoError(err)
+	assert.Equal(`#!/bin/bash
+#SBATCH --job-name=dmk-train_a_b
+#SBATCH --output=/jobs/train/stdout.txt
+#SBATCH --error=/jobs/train/stderr.txt
+#SBATCH --cpus-per-task=2
+#SBATCH --partition=short
+cd '`+filepath.Join(root, "res")+`' || exit 1
+'/bin/bash' '-c' 'python3 train.py > model.txt'
+echo $? > '/jobs/train/exitcode'
+`, script)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SSHExecutorName is the name of the executor that runs commands on another
+// host over SSH
+const SSHExecutorName = "ssh"
+
+// DefaultRemoteRoot is the directory (relative to the remote home directory)
+// holding the copy of each pipeline directory when a step doesn't give a
+// remoteDir
+const DefaultRemoteRoot = ".dmk"
+
+// SSHExecutor runs a step's command on the step's host. Inputs are copied to
+// the host before the command runs, and outputs are copied back afterwards.
+// SSH and SCP are the programs used: they should be configured (with
+// ~/.ssh/config, an agent, etc) so that they never ask for a password.
+type SSHExecutor struct {
+	SSH string
+	SCP string
+}
+
+// CheckStep makes sure the step has a host
+func (se SSHExecutor) CheckStep(step *BuildStep) error {
+	if len(step.Host) < 1 {
+		return errors.New("a host is required for the ssh executor")
+	}
+	return nil
+}
+
+// ShellQuote quotes s as a single word for a POSIX shell
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// RemoteRoot returns the directory on the host that mirrors the pipeline
+// directory: the step's remoteDir, or a directory named for the pipeline
+// directory in DefaultRemoteRoot
+func (step *BuildStep) RemoteRoot() (string, error) {
+	if len(step.RemoteDir) > 0 {
+		return step.RemoteDir, nil
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(DefaultRemoteRoot, filepath.Base(root)), nil
+}
+
+// remotePath returns the remote path for a file relative to the pipeline
+// directory. Files outside of the pipeline directory are an error.
+func remotePath(remoteDir string, file string) (string, error) {
+	clean := filepath.Clean(file)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the pipeline directory and can't be copied to the host", file)
+	}
+	return path.Join(remoteDir, filepath.ToSlash(clean)), nil
+}
+
+// RemoteCommand returns the shell command run on the host: change to the
+// working directory, read the environment from stdin, and run argv. The
+// environment is sent over stdin (see RemoteEnvScript) so that values like secrets
+// never appear on the ssh command line or in the host's process list.
+func RemoteCommand(dir string, argv []string) string {
+	words := []string{"cd", ShellQuote(dir), "&&", ".", "/dev/stdin", "&&", "exec"}
+	for _, arg := range argv {
+		words = append(words, ShellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// RemoteEnvScript returns the script read by RemoteCommand to set the
+// environment (see remoteEnv for what is set)
+func RemoteEnvScript(env []string, tracked map[string]string) string {
+	var script strings.Builder
+	for _, kv := range remoteEnv(env, tracked) {
+		fmt.Fprintf(&script, "export %s\n", ShellQuote(kv))
+	}
+	return script.String()
+}
+
+// run runs a program, returning an error with its output if it fails
+func (se SSHExecutor) run(program string, args ...string) error {
+	out, err := exec.Command(program, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", program, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Execute copies the inputs to the host, runs the command there, and copies
+// the outputs back
+func (se SSHExecutor) Execute(job Job) error {
+	step := job.Step
+	if err := se.CheckStep(step); err != nil {
+		return err
+	}
+	remoteDir, err := step.RemoteRoot()
+	if err != nil {
+		return err
+	}
+	workdir := remoteDir
+	if len(step.Workdir) > 0 {
+		if workdir, err = remotePath(remoteDir, step.Workdir); err != nil {
+			return err
+		}
+	}
+
+	// Every directory we need on the host, and the inputs by directory
+	dirs := NewUniqueStrings()
+	dirs.Add(workdir)
+	byDir := make(map[string][]string)
+	for _, in := range job.Inputs {
+		remote, err := remotePath(remoteDir, in)
+		if err != nil {
+			return err
+		}
+		dir := path.Dir(remote)
+		dirs.Add(dir)
+		byDir[dir] = append(byDir[dir], in)
+	}
+	for _, out := range step.Outputs {
+		remote, err := remotePath(remoteDir, out)
+		if err != nil {
+			return err
+		}
+		if IsDirPath(out) {
+			dirs.Add(remote)
+		} else {
+			dirs.Add(path.Dir(remote))
+		}
+	}
+
+	mkdir := []string{"mkdir", "-p"}
+	for _, dir := range dirs.Strings() {
+		mkdir = append(mkdir, ShellQuote(dir))
+	}
+	job.Verb.Printf("%s: creating directories on %s\n", step.Name, step.Host)
+	if err := se.run(se.SSH, step.Host, strings.Join(mkdir, " ")); err != nil {
+		return err
+	}
+
+	remoteDirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		remoteDirs = append(remoteDirs, dir)
+	}
+	sort.Strings(remoteDirs)
+	for _, dir := range remoteDirs {
+		files := byDir[dir]
+		job.Verb.Printf("%s: copying %d inputs to %s:%s\n", step.Name, len(files), step.Host, dir)
+		args := append([]string{"-r"}, files...)
+		if err := se.run(se.SCP, append(args, step.Host+":"+dir+"/")...); err != nil {
+			return err
+		}
+	}
+
+	// Output streams straight back to us
+	cmd := exec.Command(se.SSH, step.Host, RemoteCommand(workdir, job.Argv))
+	cmd.Stdin = strings.NewReader(RemoteEnvScript(job.Env, job.Tracked))
+	cmd.Stdout = job.Stdout
+	cmd.Stderr = job.Stderr
+	job.Verb.Printf("%s: running on %s in %s\n", step.Name, step.Host, workdir)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return se.fetchOutputs(job, remoteDir)
+}
+
+// fetchOutputs copies the step's outputs back from the host. Output globs
+// are expanded on the host.
+func (se SSHExecutor) fetchOutputs(job Job, remoteDir string) error {
+	for _, out := range job.Step.Outputs {
+		remote, err := remotePath(remoteDir, out)
+		if err != nil {
+			return err
+		}
+
+		local := out
+		args := []string{}
+		if IsDirPath(out) {
+			// Copy the directory into its parent
+			local = filepath.Dir(filepath.Clean(out))
+			args = append(args, "-r")
+		} else if IsGlob(out) {
+			local = filepath.Dir(out)
+		}
+		if dir := filepath.Dir(out); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+
+		job.Verb.Printf("%s: copying %s back from %s\n", job.Step.Name, out, job.Step.Host)
+		args = append(args, job.Step.Host+":"+remote, local)
+		if err := se.run(se.SCP, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
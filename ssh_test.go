@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellQuote(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(`'plain'`, ShellQuote("plain"))
+	assert.Equal(`'a b $HOME'`, ShellQuote("a b $HOME"))
+	assert.Equal(`'it'"'"'s'`, ShellQuote("it's"))
+}
+
+func TestRemoteCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd := RemoteCommand(".dmk/my pipe", []string{"/bin/bash", "-c", "cat in.txt > out.txt"})
+	assert.Equal(`cd '.dmk/my pipe' && . /dev/stdin && exec '/bin/bash' '-c' 'cat in.txt > out.txt'`, cmd)
+
+	env := RemoteEnvScript(
+		[]string{"DMK_STEPNAME=train", "HOME=/home/me", "MODEL=x y"},
+		map[string]string{"MODEL": "x y"})
+	assert.Equal("export 'DMK_STEPNAME=train'\nexport 'MODEL=x y'\n", env)
+}
+
+func TestRemoteRoot(t *testing.T) {
+	assert := assert.New(t)
+
+	root, err := os.Getwd()
+	pcheck(err)
+	dir, err := (&BuildStep{}).RemoteRoot()
+	assert.NoError(err)
+	assert.Equal(DefaultRemoteRoot+"/"+filepath.Base(root), dir)
+	dir, err = (&BuildStep{RemoteDir: "/scratch/me"}).RemoteRoot()
+	assert.NoError(err)
+	assert.Equal("/scratch/me", dir)
+
+	remote, err := remotePath("/scratch/me", "data/./in.txt")
+	assert.NoError(err)
+	assert.Equal("/scratch/me/data/in.txt", remote)
+	_, err = remotePath("/scratch/me", "../in.txt")
+	assert.Error(err)
+	_, err = remotePath("/scratch/me", "/etc/passwd")
+	assert.Error(err)
+}
+
+func TestSSHCheckStep(t *testing.T) {
+	assert := assert.New(t)
+
+	se := SSHExecutor{SSH: "ssh", SCP: "scp"}
+	assert.Error(se.CheckStep(&BuildStep{}))
+	assert.NoError(se.CheckStep(&BuildStep{Host: "worker"}))
+
+	_, err := (&BuildStep{Executor: SSHExecutorName}).LookupExecutor()
+	assert.Error(err)
+	_, err = ReadConfig([]byte("a:\n    command: x\n    executor: ssh\n"))
+	assert.Error(err)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StateFileName is the file (in the pipeline file's directory) where dmk
+// keeps what it learns about steps between runs
+const StateFileName = ".dmk-state.json"
+
+// SaltFileName is the file (next to the state file) holding the random value
+// hashed with secrets in fingerprints. It's kept out of the state file and is
+// only readable by its owner, so sharing the state doesn't share the salt.
+const SaltFileName = ".dmk-salt"
+
+// StepState is everything remembered about a single step
+type StepState struct {
+	// Files found for output globs and directories after the last build
+	Discovered map[string][]string `json:"discovered,omitempty"`
+	// Content hashes of directory inputs from the last build
+	DirHashes map[string]string `json:"dirHashes,omitempty"`
+	// Hashes of the step's tracked environment values (see Fingerprint):
+	// kept even if empty, since empty is different from never recorded
+	Fingerprint map[string]string `json:"fingerprint"`
+}
+
+// BuildState is the concurrent-safe collection of all step state
+type BuildState struct {
+	Steps map[string]*StepState `json:"steps"`
+
+	path  string
+	salt  string // Read from SaltFileName (see Salt)
+	dirty bool
+	lock  sync.Mutex
+}
+
+// NewBuildState returns an empty state that will be saved to path
+func NewBuildState(path string) *BuildState {
+	return &BuildState{
+		Steps: make(map[string]*StepState),
+		path:  path,
+	}
+}
+
+// LoadState reads the state file at path. If the file doesn't exist, an
+// empty state is returned.
+func LoadState(path string) (*BuildState, error) {
+	state := NewBuildState(path)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Steps == nil {
+		state.Steps = make(map[string]*StepState)
+	}
+	return state, nil
+}
+
+// Save writes the state file if anything has changed. If there is nothing
+// left to remember, the state file is removed.
+func (s *BuildState) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	if len(s.Steps) < 1 {
+		err := os.Remove(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.dirty = false
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path, data, 0644); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Discovered returns the files found for a step's output glob or directory
+// in the last build, and false if nothing has been recorded
+func (s *BuildState) Discovered(stepName string, output string) ([]string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	step, ok := s.Steps[stepName]
+	if !ok {
+		return nil, false
+	}
+	files, ok := step.Discovered[output]
+	return files, ok
+}
+
+// SetDiscovered records the files found for a step's output glob or directory
+func (s *BuildState) SetDiscovered(stepName string, output string, files []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	step, ok := s.Steps[stepName]
+	if !ok {
+		step = &StepState{}
+		s.Steps[stepName] = step
+	}
+	if step.Discovered == nil {
+		step.Discovered = make(map[string][]string)
+	}
+
+	sorted := append([]string{}, files...)
+	sort.Strings(sorted)
+	step.Discovered[output] = sorted
+	s.dirty = true
+}
+
+// DirHashes returns a copy of the directory input hashes recorded for the step
+func (s *BuildState) DirHashes(stepName string) map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hashes := make(map[string]string)
+	if step, ok := s.Steps[stepName]; ok {
+		for k, v := range step.DirHashes {
+			hashes[k] = v
+		}
+	}
+	return hashes
+}
+
+// SetDirHashes records the directory input hashes for the step
+func (s *BuildState) SetDirHashes(stepName string, hashes map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	step, ok := s.Steps[stepName]
+	if !ok {
+		step = &StepState{}
+		s.Steps[stepName] = step
+	}
+	step.DirHashes = make(map[string]string, len(hashes))
+	for k, v := range hashes {
+		step.DirHashes[k] = v
+	}
+	s.dirty = true
+}
+
+// Fingerprint returns a copy of the environment fingerprint recorded for the
+// step, and false if nothing has been recorded
+func (s *BuildState) Fingerprint(stepName string) (map[string]string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	step, ok := s.Steps[stepName]
+	if !ok || step.Fingerprint == nil {
+		return nil, false
+	}
+	fp := make(map[string]string, len(step.Fingerprint))
+	for k, v := range step.Fingerprint {
+		fp[k] = v
+	}
+	return fp, true
+}
+
+// SetFingerprint records the environment fingerprint for the step. An empty
+// fingerprint is only recorded if it replaces one that wasn't empty: never
+// recorded is the same as empty for a step without tracked values, and this
+// keeps pipelines that don't use them from needing a state file.
+func (s *BuildState) SetFingerprint(stepName string, fp map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	step, ok := s.Steps[stepName]
+	if len(fp) < 1 && (!ok || len(step.Fingerprint) < 1) {
+		return // Nothing new to save
+	}
+	if !ok {
+		step = &StepState{}
+		s.Steps[stepName] = step
+	}
+	if step.Fingerprint != nil && FingerprintChange(step.Fingerprint, fp) == "" {
+		return // Nothing new to save
+	}
+	step.Fingerprint = make(map[string]string, len(fp))
+	for k, v := range fp {
+		step.Fingerprint[k] = v
+	}
+	s.dirty = true
+}
+
+// Salt returns the random value used when hashing secrets for fingerprints.
+// It's read from SaltFileName, which is created the first time it's needed.
+func (s *BuildState) Salt() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.salt) > 0 {
+		return s.salt, nil
+	}
+
+	path := filepath.Join(filepath.Dir(s.path), SaltFileName)
+	data, err := ioutil.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		s.salt = strings.TrimSpace(string(data))
+		return s.salt, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	salt := hex.EncodeToString(buf)
+	if err := ioutil.WriteFile(path, []byte(salt+"\n"), 0600); err != nil {
+		return "", err
+	}
+	s.salt = salt
+	return s.salt, nil
+}
+
+// Forget removes everything remembered about a step
+func (s *BuildState) Forget(stepName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.Steps[stepName]; ok {
+		delete(s.Steps, stepName)
+		s.dirty = true
+	}
+}
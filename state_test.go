@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildState(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, StateFileName)
+
+	// Missing file is just an empty state, and saving nothing writes nothing
+	state, err := LoadState(path)
+	assert.NoError(err)
+	assert.Len(state.Steps, 0)
+	assert.NoError(state.Save())
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	_, found := state.Discovered("step", "parts/*.txt")
+	assert.False(found)
+
+	state.SetDiscovered("step", "parts/*.txt", []string{"parts/b.txt", "parts/a.txt"})
+	state.SetDiscovered("step", "dir/", []string{})
+	assert.NoError(state.Save())
+
+	// Round trip
+	state, err = LoadState(path)
+	assert.NoError(err)
+	files, found := state.Discovered("step", "parts/*.txt")
+	assert.True(found)
+	assert.Equal([]string{"parts/a.txt", "parts/b.txt"}, files)
+	files, found = state.Discovered("step", "dir/")
+	assert.True(found)
+	assert.Len(files, 0)
+	_, found = state.Discovered("other", "dir/")
+	assert.False(found)
+
+	// Directory hashes are copied in and out
+	hashes := map[string]string{"src": "abc"}
+	state.SetDirHashes("step", hashes)
+	hashes["src"] = "changed"
+	assert.Equal(map[string]string{"src": "abc"}, state.DirHashes("step"))
+	assert.Len(state.DirHashes("other"), 0)
+
+	// Fingerprints are only saved when they change, and empty ones only when
+	// replacing one that wasn't
+	_, found = state.Fingerprint("step")
+	assert.False(found)
+	assert.NoError(state.Save())
+	state.SetFingerprint("step", map[string]string{})
+	state.SetFingerprint("other", map[string]string{})
+	assert.False(state.dirty)
+	_, found = state.Fingerprint("step")
+	assert.False(found)
+	assert.NotContains(state.Steps, "other")
+	state.SetFingerprint("step", map[string]string{"A": "hash"})
+	fp, found := state.Fingerprint("step")
+	assert.True(found)
+	assert.Equal(map[string]string{"A": "hash"}, fp)
+	assert.NoError(state.Save())
+	state.SetFingerprint("step", map[string]string{"A": "hash"})
+	assert.False(state.dirty)
+	state.SetFingerprint("step", map[string]string{})
+	assert.True(state.dirty)
+	fp, found = state.Fingerprint("step")
+	assert.True(found)
+	assert.Len(fp, 0)
+
+	// The salt is created once, in its own file that only we can read
+	assert.NoError(state.Save())
+	salt, err := state.Salt()
+	assert.NoError(err)
+	assert.Len(salt, 64)
+	again, err := state.Salt()
+	assert.NoError(err)
+	assert.Equal(salt, again)
+	info, err := os.Stat(filepath.Join(dir, SaltFileName))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	data, err := ioutil.ReadFile(path)
+	pcheck(err)
+	assert.NotContains(string(data), salt)
+	loaded, err := LoadState(path)
+	assert.NoError(err)
+	again, err = loaded.Salt()
+	assert.NoError(err)
+	assert.Equal(salt, again)
+
+	// Forgetting everything removes the file
+	state.Forget("other")
+	state.Forget("step")
+	assert.NoError(state.Save())
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	// Bad files are errors
+	pcheck(ioutil.WriteFile(path, []byte("not json"), 0644))
+	_, err = LoadState(path)
+	assert.Error(err)
+}
@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
 const (
@@ -28,6 +31,19 @@ type BuildStepInstance struct {
 	verb    *log.Logger
 	decider Decider
 	broad   *Broadcaster
+	state   *BuildState
+	peers   map[string]*BuildStepInstance // Steps we need or run after
+	ran     bool                          // True if our command was executed
+	redact  *strings.Replacer             // Masks secrets in anything we print
+}
+
+// stepMsgPrefix starts the broadcast message sent when a step finishes. The
+// NUL keeps it from ever matching a file name.
+const stepMsgPrefix = "\x00step:"
+
+// StepMessage is the message broadcast when the named step is finished
+func StepMessage(name string) string {
+	return stepMsgPrefix + name
 }
 
 // Can be our stand in below OR bytes.buffer
@@ -36,19 +52,25 @@ type stepOutput interface {
 	String() string
 }
 
-// Used in place of bytes.Buffer for direct output
+// Used in place of bytes.Buffer for direct output. Secrets are masked in
+// each write, so a secret split across two writes is NOT masked.
 type directOutput struct {
-	dest io.Writer
+	dest   io.Writer
+	redact *strings.Replacer
 }
 
-func newDirectOutput(w io.Writer) *directOutput {
+func newDirectOutput(w io.Writer, redact *strings.Replacer) *directOutput {
 	return &directOutput{
-		dest: w,
+		dest:   w,
+		redact: redact,
 	}
 }
 
 func (do *directOutput) Write(p []byte) (int, error) {
-	return do.dest.Write(p)
+	if _, err := do.redact.WriteString(do.dest, string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
 func (do *directOutput) String() string {
@@ -56,57 +78,467 @@ func (do *directOutput) String() string {
 }
 
 // NewBuildStepInst creates an unstarted instance from the BuildStep
-func NewBuildStepInst(step *BuildStep, allOutputs map[string]bool, verb *log.Logger, broad *Broadcaster) *BuildStepInstance {
-	deps := make([]string, 0, len(step.Inputs))
-	for _, file := range step.Inputs {
-		if _, inMap := allOutputs[file]; inMap {
-			deps = append(deps, file)
+func NewBuildStepInst(step *BuildStep, allOutputs map[string]bool, verb *log.Logger, broad *Broadcaster, state *BuildState) *BuildStepInstance {
+	ownOutputs := make(map[string]bool)
+	for _, file := range step.Outputs {
+		ownOutputs[file] = true
+	}
+
+	found := NewUniqueStrings()
+	for output := range allOutputs {
+		if ownOutputs[output] {
+			continue
+		}
+		for _, file := range step.Inputs {
+			if Produces(output, file) {
+				found.Add(output)
+				break
+			}
 		}
 	}
+	deps := found.Strings()
 
 	verb.Printf("%s: Found %d deps\n", step.Name, len(deps))
 
-	// If verbose, output vars in sorted order
+	// If verbose, output vars in sorted order (with secrets masked)
+	redact := step.Redactor(nil)
 	varKeys := []string{}
 	for k := range step.Vars {
 		varKeys = append(varKeys, k)
 	}
 	sort.Strings(varKeys)
 	for _, k := range varKeys {
-		verb.Printf("%s: var[%s]=='%s'\n", step.Name, k, step.Vars[k])
+		verb.Printf("%s: var[%s]=='%s'\n", step.Name, k, redact.Replace(step.Vars[k]))
 	}
 
 	return &BuildStepInstance{
-		Step:    step,
-		Deps:    deps,
-		State:   buildUnstarted,
-		verb:    verb,
-		decider: TimeDecider{},
-		broad:   broad,
+		Step:  step,
+		Deps:  deps,
+		State: buildUnstarted,
+		verb:  verb,
+		decider: TimeDecider{
+			Filter:    DirFilter{Include: step.DirInclude, Exclude: step.DirExclude},
+			HashDirs:  step.DirHash,
+			DirHashes: state.DirHashes(step.Name),
+		},
+		broad:  broad,
+		state:  state,
+		peers:  make(map[string]*BuildStepInstance),
+		redact: redact,
+	}
+}
+
+// Link finds the instances for the steps we need or run after. Steps that
+// aren't being run are ignored, since there is nothing to wait for.
+func (i *BuildStepInstance) Link(running []*BuildStepInstance) {
+	byName := make(map[string]*BuildStepInstance)
+	for _, inst := range running {
+		byName[inst.Step.Name] = inst
+	}
+	for _, name := range i.Step.StepDeps() {
+		if peer, ok := byName[name]; ok {
+			i.peers[name] = peer
+		}
+	}
+}
+
+// OutputFiles returns the files currently matching the step's output globs
+// along with any files recorded for them in the state (which may be nil)
+func OutputFiles(step *BuildStep, state *BuildState) ([]string, error) {
+	found := NewUniqueStrings()
+	for _, out := range step.Outputs {
+		if !IsGlob(out) {
+			continue
+		}
+		matches, err := filepath.Glob(out)
+		if err != nil {
+			return []string{}, err
+		}
+		for _, m := range matches {
+			found.Add(m)
+		}
+		if state != nil {
+			files, _ := state.Discovered(step.Name, out)
+			for _, f := range files {
+				found.Add(f)
+			}
+		}
+	}
+	return found.Strings(), nil
+}
+
+// knownOutputs returns the files for the step's outputs. Output globs and
+// directories use the files found after the last build: if nothing was found
+// yet, the glob or directory itself is used (so a glob counts as missing).
+func (i *BuildStepInstance) knownOutputs() []string {
+	outputs := make([]string, 0, len(i.Step.Outputs))
+	for _, out := range i.Step.Outputs {
+		if !IsGlob(out) && !IsDirPath(out) {
+			outputs = append(outputs, out)
+			continue
+		}
+		files, found := i.state.Discovered(i.Step.Name, out)
+		if !found {
+			outputs = append(outputs, out)
+			continue
+		}
+		if len(files) < 1 {
+			files = []string{filepath.Clean(out)} // Empty directory
+		}
+		outputs = append(outputs, files...)
+	}
+	return outputs
+}
+
+// discoverOutputs finds the files for the step's output globs and
+// directories after the command has run and records them. Every output glob
+// must match at least one file and every output directory must exist.
+func (i *BuildStepInstance) discoverOutputs() error {
+	for _, out := range i.Step.Outputs {
+		var files []string
+		var err error
+
+		if IsDirPath(out) {
+			files, err = WalkFiles(filepath.Clean(out))
+			if err != nil {
+				return fmt.Errorf("Output directory %s: %v", out, err)
+			}
+		} else if IsGlob(out) {
+			files, err = filepath.Glob(out)
+			if err != nil {
+				return err
+			}
+			if len(files) < 1 {
+				return fmt.Errorf("Output glob %s matched no files", out)
+			}
+		} else {
+			continue
+		}
+
+		i.verb.Printf("%s: found %d files for %s\n", i.Step.Name, len(files), i.masked(out))
+		i.state.SetDiscovered(i.Step.Name, out, files)
+	}
+	return nil
+}
+
+// CheckOutputs makes sure that the step's outputs exist without building
+// anything. Files found for output globs and directories are recorded.
+func (i *BuildStepInstance) CheckOutputs() error {
+	for _, out := range i.Step.Outputs {
+		if IsGlob(out) || IsDirPath(out) {
+			continue
+		}
+		if _, err := os.Stat(out); err != nil {
+			return fmt.Errorf("Output %s: %v", out, err)
+		}
+	}
+	return i.discoverOutputs()
+}
+
+// Touch marks the step as up to date without running the command: every
+// output gets the time given (or the newest input time if that is later) and
+// directory input hashes are recorded. CheckOutputs must be called first.
+func (i *BuildStepInstance) Touch(now time.Time) error {
+	inputs, err := MultiGlob(i.Step.Inputs)
+	if err != nil {
+		return err
+	}
+	if missing, err := AnyMissing(inputs); missing || err != nil {
+		if err == nil {
+			err = errors.New("Missing a dependency: cannot touch")
+		}
+		return err
+	}
+
+	_, tracked, err := i.Step.Environment(nil)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := i.fingerprint(tracked)
+	if err != nil {
+		return err
 	}
+	i.state.SetFingerprint(i.Step.Name, fingerprint)
+
+	touchTime := now
+	if td, ok := i.decider.(TimeDecider); ok {
+		newest, err := td.Filter.MaxTime(inputs)
+		if err != nil {
+			return err
+		}
+		if newest.After(touchTime) {
+			touchTime = newest
+		}
+
+		if td.HashDirs {
+			hashes, err := td.CurrentHashes(inputs)
+			if err != nil {
+				return err
+			}
+			i.state.SetDirHashes(i.Step.Name, hashes)
+		}
+	}
+
+	for _, file := range i.knownOutputs() {
+		i.verb.Printf("%s: touching %s\n", i.Step.Name, i.masked(file))
+		if err := os.Chtimes(file, touchTime, touchTime); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Tell everyone that our outputs are done (even if we failed)
+// fingerprint hashes the tracked environment values. Secrets are hashed with
+// the salt from SaltFileName, which is only created if the step has secrets.
+func (i *BuildStepInstance) fingerprint(tracked map[string]string) (map[string]string, error) {
+	salt := ""
+	if len(i.Step.Secrets) > 0 {
+		var err error
+		if salt, err = i.state.Salt(); err != nil {
+			return nil, err
+		}
+	}
+	return Fingerprint(tracked, i.Step.IsSecret, salt), nil
+}
+
+// masked returns the text with every secret value masked
+func (i *BuildStepInstance) masked(text string) string {
+	if i.redact == nil {
+		return text
+	}
+	return i.redact.Replace(text)
+}
+
+// envChange describes how the fingerprint differs from the one recorded for
+// the last build. If nothing has been recorded yet, there is no change.
+func (i *BuildStepInstance) envChange(fingerprint map[string]string) string {
+	prev, recorded := i.state.Fingerprint(i.Step.Name)
+	if !recorded {
+		return ""
+	}
+	return FingerprintChange(prev, fingerprint)
+}
+
+// decide asks the decider if we need to build, along with the reason if the
+// decider can explain itself
+func (i *BuildStepInstance) decide(inputs []string, outputs []string) (bool, string, error) {
+	if ex, ok := i.decider.(Explainer); ok {
+		return ex.Explain(inputs, outputs)
+	}
+	need, err := i.decider.NeedBuild(inputs, outputs)
+	return need, "", err
+}
+
+// Explain writes everything that goes into deciding if the step runs: the
+// command, every input (with the steps producing it) and output, and the
+// decision along with the reason for it. Other steps aren't run, so this is
+// the decision if the step ran right now.
+func (i *BuildStepInstance) Explain(cfg ConfigFile, out *log.Logger) error {
+	env, tracked, err := i.Step.Environment(nil)
+	if err != nil {
+		return err
+	}
+	i.redact = i.Step.Redactor(env)
+
+	out.Printf("STEP: %s\n", i.Step.Name)
+	out.Printf("COMMAND: %s\n", i.masked(i.Step.CommandText()))
+	if len(i.Step.Args) < 1 {
+		out.Printf("SHELL: %s\n", i.Step.Shell)
+	}
+	if len(i.Step.Workdir) > 0 {
+		out.Printf("WORKDIR: %s\n", i.masked(i.Step.Workdir))
+	}
+	if name := i.Step.ExecutorName(); name != LocalExecutorName {
+		out.Printf("EXECUTOR: %s\n", name)
+	}
+	if len(i.Step.Host) > 0 {
+		out.Printf("HOST: %s\n", i.masked(i.Step.Host))
+	}
+	if opts := i.Step.Resources.SbatchOptions(); len(opts) > 0 {
+		out.Printf("RESOURCES: %s\n", i.masked(strings.Join(opts, " ")))
+	}
+	if len(i.Step.Image) > 0 {
+		runner := i.Step.Runner
+		if len(runner) < 1 {
+			runner = DefaultRunner
+		}
+		out.Printf("IMAGE: %s (with %s)\n", i.masked(i.Step.Image), runner)
+	}
+
+	td, _ := i.decider.(TimeDecider)
+
+	out.Printf("INPUTS:\n")
+	for _, in := range i.Step.Inputs {
+		producers := []string{}
+		for name, other := range cfg {
+			if name == i.Step.Name {
+				continue
+			}
+			for _, o := range other.Outputs {
+				if Produces(o, in) {
+					producers = append(producers, name)
+					break
+				}
+			}
+		}
+		sort.Strings(producers)
+		from := ""
+		if len(producers) > 0 {
+			from = fmt.Sprintf(" (from %s)", strings.Join(producers, ", "))
+		}
+
+		if !IsGlob(in) {
+			out.Printf("  %s: %s%s\n", i.masked(in), describeFile(td, in), from)
+			continue
+		}
+		matches, err := filepath.Glob(in)
+		if err != nil {
+			return err
+		}
+		out.Printf("  %s: glob matching %d files%s\n", i.masked(in), len(matches), from)
+		for _, m := range matches {
+			out.Printf("    %s: %s\n", i.masked(m), describeFile(td, m))
+		}
+	}
+
+	out.Printf("OUTPUTS:\n")
+	for _, o := range i.knownOutputs() {
+		out.Printf("  %s: %s\n", i.masked(o), describeFile(TimeDecider{}, o))
+	}
+
+	if deps := i.Step.StepDeps(); len(deps) > 0 {
+		out.Printf("NEEDS: %s\n", strings.Join(i.Step.Needs, ", "))
+		out.Printf("AFTER: %s\n", strings.Join(i.Step.After, ", "))
+	}
+
+	switch {
+	case i.Step.Phony:
+		out.Printf("DECISION: run (phony steps always run)\n")
+	case i.Step.Force:
+		out.Printf("DECISION: run (forced from the command line)\n")
+	case i.Step.Always:
+		out.Printf("DECISION: run (always=true)\n")
+	default:
+		inputs, err := MultiGlob(i.Step.Inputs)
+		if err != nil {
+			return err
+		}
+		need, reason, err := i.decide(inputs, i.knownOutputs())
+		if err == nil && !need {
+			fingerprint, fpErr := i.fingerprint(tracked)
+			if fpErr != nil {
+				return fpErr
+			}
+			if change := i.envChange(fingerprint); change != "" {
+				need, reason = true, change
+			}
+		}
+		if err != nil {
+			out.Printf("DECISION: error - %s\n", i.masked(err.Error()))
+		} else if need {
+			out.Printf("DECISION: run\n")
+		} else {
+			out.Printf("DECISION: up to date\n")
+		}
+		if reason != "" {
+			out.Printf("REASON: %s\n", i.masked(reason))
+		}
+	}
+	return nil
+}
+
+// describeFile returns the mod time for a file. For a directory, it's the
+// newest file in the directory (and the hash if the decider uses hashes).
+func describeFile(td TimeDecider, file string) string {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return "MISSING"
+	} else if err != nil {
+		return err.Error()
+	}
+	if !info.IsDir() {
+		return info.ModTime().Format(time.RFC3339Nano)
+	}
+
+	newest, when, err := td.Filter.Newest([]string{file})
+	if err != nil {
+		return err.Error()
+	}
+	desc := fmt.Sprintf("directory, newest is %s (%s)", newest, when.Format(time.RFC3339Nano))
+	if td.HashDirs {
+		hash, err := td.Filter.Hash(file)
+		if err != nil {
+			return err.Error()
+		}
+		prev, ok := td.DirHashes[file]
+		if !ok {
+			prev = "none"
+		}
+		desc += fmt.Sprintf(", hash %s (recorded %s)", hash, prev)
+	}
+	return desc
+}
+
+// reportTrace logs the difference between the files in the trace and the
+// step's inputs and outputs
+func (i *BuildStepInstance) reportTrace(traceFile string, inputs []string) error {
+	f, err := os.Open(traceFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dir := "."
+	if len(i.Step.Workdir) > 0 {
+		dir = i.Step.Workdir
+	}
+	access, err := ParseTrace(f, dir)
+	if err != nil {
+		return err
+	}
+	report, err := CheckTrace(i.Step, inputs, access)
+	if err != nil {
+		return err
+	}
+
+	if report.IsEmpty() {
+		i.verb.Printf("%s: trace matches the declared inputs and outputs\n", i.Step.Name)
+	}
+	for _, file := range report.UndeclaredInputs {
+		log.Printf("%s: TRACE read %s, which is not an input\n", i.Step.Name, i.masked(file))
+	}
+	for _, file := range report.UndeclaredOutputs {
+		log.Printf("%s: TRACE wrote %s, which is not an output\n", i.Step.Name, i.masked(file))
+	}
+	for _, file := range report.UnreadInputs {
+		log.Printf("%s: TRACE never read input %s\n", i.Step.Name, i.masked(file))
+	}
+	return nil
+}
+
+// Tell everyone that our outputs are done (even if we failed). Our state must
+// be set first: steps that need us check it when they get the message.
 func (i *BuildStepInstance) notify() {
-	for _, file := range i.Step.Outputs {
-		i.verb.Printf("%s: notifying for %s\n", i.Step.Name, file)
-		err := i.broad.Send(file)
+	msgs := append(append([]string{}, i.Step.Outputs...), StepMessage(i.Step.Name))
+	for _, msg := range msgs {
+		i.verb.Printf("%s: notifying for %q\n", i.Step.Name, i.masked(msg))
+		err := i.broad.Send(msg)
 		if err != nil {
-			i.verb.Printf("%s: ERROR on broadcast send for %s - %v\n", i.Step.Name, file, err)
+			i.verb.Printf("%s: ERROR on broadcast send for %q - %v\n", i.Step.Name, i.masked(msg), err)
 		}
 	}
 }
 
 func (i *BuildStepInstance) fail(err error) error {
-	i.notify()
 	i.State = buildFailed
-	log.Printf("%s: FAIL - %s\n", i.Step.Name, err.Error())
+	i.notify()
+	log.Printf("%s: FAIL - %s\n", i.Step.Name, i.masked(err.Error()))
 	return err
 }
 
 func (i *BuildStepInstance) succeed() error {
-	i.notify()
 	i.State = buildCompleted
+	i.notify()
 	log.Printf("%s: Complete\n", i.Step.Name)
 	return nil
 }
@@ -130,13 +562,16 @@ func (i *BuildStepInstance) Run() error {
 	// The step is "Started"
 	i.State = buildStarted
 
-	// If any of the required inputs are another step's outputs, then wait for
-	// a built message for all our deps
-	if len(i.Deps) > 0 {
+	// If any of the required inputs are another step's outputs (or we need or
+	// run after other steps), then wait for a built message for all our deps
+	if len(i.Deps)+len(i.peers) > 0 {
 		waitingDeps := make(map[string]bool)
 		for _, d := range i.Deps {
 			waitingDeps[d] = true
 		}
+		for name := range i.peers {
+			waitingDeps[StepMessage(name)] = true
+		}
 		i.verb.Printf("%s: waiting for %d deps\n", i.Step.Name, len(waitingDeps))
 
 		list := i.broad.GetListener()
@@ -160,64 +595,186 @@ func (i *BuildStepInstance) Run() error {
 		}
 	}
 
-	// If we have inputs, check to see if we need to build
-	needBuild, err := i.decider.NeedBuild(i.Step.Inputs, i.Step.Outputs)
+	// Steps we need or run after must have worked, and if a step we need
+	// actually ran then we must run too
+	forced := false
+	for idx, name := range i.Step.StepDeps() {
+		peer, ok := i.peers[name]
+		if !ok {
+			continue
+		}
+		if peer.State != buildCompleted {
+			return i.fail(fmt.Errorf("Required step %s did not complete", name))
+		}
+		if peer.ran && idx < len(i.Step.Needs) { // StepDeps lists needs first
+			i.verb.Printf("%s: needed step %s ran\n", i.Step.Name, name)
+			forced = true
+		}
+	}
+
+	// Inputs naming an output glob can only be globbed now
+	inputs, err := MultiGlob(i.Step.Inputs)
 	if err != nil {
-		i.verb.Printf("%s: failing on build decision\n", i.Step.Name)
 		return i.fail(err)
 	}
-	if !needBuild {
-		i.verb.Printf("%s: Nothing to do\n", i.Step.Name)
-		return i.succeed()
+
+	// Phony, forced and always=true steps always run (but they still need
+	// their inputs)
+	if i.Step.Force || i.Step.Always {
+		i.verb.Printf("%s: forced to run\n", i.Step.Name)
+		forced = true
+	}
+	if i.Step.Phony {
+		forced = true
+	}
+
+	// The environment is part of deciding if we need to build
+	env, tracked, err := i.Step.Environment(map[string]string{
+		// DMK_VERSION is set on startup, DMK_PIPELINE is set after reading the file
+		"DMK_STEPNAME": i.Step.Name,
+		// File lists are relative to the working directory
+		"DMK_INPUTS":  strings.Join(i.Step.WorkdirPaths(inputs), ":"),
+		"DMK_OUTPUTS": strings.Join(i.Step.WorkdirPaths(i.Step.Outputs), ":"),
+		"DMK_CLEAN":   strings.Join(i.Step.WorkdirPaths(i.Step.Clean), ":"),
+	})
+	if err != nil {
+		return i.fail(err)
+	}
+	i.redact = i.Step.Redactor(env)
+	fingerprint, err := i.fingerprint(tracked)
+	if err != nil {
+		return i.fail(err)
+	}
+
+	if forced {
+		if missing, err := AnyMissing(inputs); missing || err != nil {
+			if err == nil {
+				err = errors.New("Missing a dependency: cannot build")
+			}
+			return i.fail(err)
+		}
+	} else {
+		// Check to see if we need to build
+		needBuild, reason, err := i.decide(inputs, i.knownOutputs())
+		if err != nil {
+			i.verb.Printf("%s: failing on build decision\n", i.Step.Name)
+			return i.fail(err)
+		}
+		if !needBuild {
+			reason = i.envChange(fingerprint)
+			needBuild = reason != ""
+		}
+		if !needBuild {
+			i.verb.Printf("%s: Nothing to do\n", i.Step.Name)
+			if !i.Step.Phony {
+				i.state.SetFingerprint(i.Step.Name, fingerprint)
+			}
+			return i.succeed()
+		}
+		if reason != "" {
+			i.verb.Printf("%s: build needed: %s\n", i.Step.Name, i.masked(reason))
+		}
 	}
 
 	// Time to execute!
 	i.State = buildExecuting
-	log.Printf("%s: %s\n", i.Step.Name, i.Step.Command)
+	i.ran = true
+	log.Printf("%s: %s\n", i.Step.Name, i.masked(i.Step.CommandText()))
+
+	// A list command is run directly, otherwise we use the shell
+	var argv []string
+	if len(i.Step.Args) > 0 {
+		argv = SpliceArgs(i.Step.Args, i.Step.WorkdirPaths(inputs), i.Step.WorkdirPaths(i.Step.Outputs))
+		if len(argv) < 1 {
+			return i.fail(errors.New("Command is empty after adding inputs and outputs"))
+		}
+	} else {
+		argv, err = i.Step.Shell.Argv(i.Step.Command)
+		if err != nil {
+			return i.fail(err)
+		}
+		i.verb.Printf("%s: running with %s\n", i.Step.Name, i.Step.Shell)
+	}
 
-	cmd := exec.Command("/bin/bash", "-c", i.Step.Command)
+	// The executor decides where the command runs
+	executor, err := i.Step.LookupExecutor()
+	if err != nil {
+		return i.fail(err)
+	}
+	if name := i.Step.ExecutorName(); name != LocalExecutorName {
+		i.verb.Printf("%s: running with the %s executor\n", i.Step.Name, name)
+	}
 
-	env := os.Environ()
-	// Some variables are already set in our environment
-	// DMK_VERSION is set on startup, DMK_PIPELINE is set after reading the file
-	env = append(env, fmt.Sprintf("DMK_STEPNAME=%s", i.Step.Name))
-	env = append(env, fmt.Sprintf("DMK_INPUTS=%v", strings.Join(i.Step.Inputs, ":")))
-	env = append(env, fmt.Sprintf("DMK_OUTPUTS=%v", strings.Join(i.Step.Outputs, ":")))
-	env = append(env, fmt.Sprintf("DMK_CLEAN=%v", strings.Join(i.Step.Clean, ":")))
-	// Now add the step variables to the environment
-	for k, v := range i.Step.Vars {
-		env = append(env, fmt.Sprintf("%v=%v", k, v))
+	// Tracing runs the command under strace to see the files it really uses
+	traceFile := ""
+	if i.Step.Trace && i.Step.ExecutorName() != LocalExecutorName {
+		log.Printf("%s: tracing is only supported for the %s executor\n", i.Step.Name, LocalExecutorName)
+	} else if i.Step.Trace {
+		if _, err := exec.LookPath(TraceProgram); err != nil {
+			return i.fail(fmt.Errorf("Tracing requires %s: %v", TraceProgram, err))
+		}
+		f, err := ioutil.TempFile("", "dmk-trace-")
+		if err != nil {
+			return i.fail(err)
+		}
+		traceFile = f.Name()
+		if err := f.Close(); err != nil {
+			return i.fail(err)
+		}
+		defer os.Remove(traceFile)
+		argv = TraceArgv(argv, traceFile)
+		i.verb.Printf("%s: tracing to %s\n", i.Step.Name, traceFile)
+	}
+
+	// Everything but the command itself is still relative to the pipeline
+	if len(i.Step.Workdir) > 0 {
+		if info, err := os.Stat(i.Step.Workdir); err != nil || !info.IsDir() {
+			return i.fail(fmt.Errorf("Working directory %s is not a directory", i.Step.Workdir))
+		}
+		i.verb.Printf("%s: running in %s\n", i.Step.Name, i.masked(i.Step.Workdir))
 	}
-	cmd.Env = env
 
 	var stdOut stepOutput
 	var stdErr stepOutput
 
 	if i.Step.Direct {
-		stdOut = newDirectOutput(os.Stdout)
-		stdErr = newDirectOutput(os.Stderr)
+		stdOut = newDirectOutput(os.Stdout, i.redact)
+		stdErr = newDirectOutput(os.Stderr, i.redact)
 	} else {
 		stdOut = &bytes.Buffer{}
 		stdErr = &bytes.Buffer{}
 	}
 
-	cmd.Stdout = stdOut
-	cmd.Stderr = stdErr
+	if i.Step.Env.IsClean() {
+		i.verb.Printf("%s: running with a clean environment\n", i.Step.Name)
+	}
+	for _, kv := range env {
+		i.verb.Printf("%s: env %s\n", i.Step.Name, i.masked(kv))
+	}
 
-	cmdErr := cmd.Run()
+	cmdErr := executor.Execute(Job{
+		Step:    i.Step,
+		Argv:    argv,
+		Env:     env,
+		Tracked: tracked,
+		Inputs:  inputs,
+		Stdout:  stdOut,
+		Stderr:  stdErr,
+		Verb:    i.verb,
+	})
 
 	stdoutText := strings.TrimSpace(stdOut.String())
 	stderrText := strings.TrimSpace(stdErr.String())
 	if len(stdoutText) > 0 {
 		i.verb.Printf("%s stdout begin---\n%s\n---stdout end for %s\n",
 			i.Step.Name,
-			stdOut.String(),
+			i.masked(stdOut.String()),
 			i.Step.Name)
 	}
 	if len(stderrText) > 0 {
 		log.Printf("%s stderr begin---\n%s\n---stderr end for %s\n",
 			i.Step.Name,
-			stdErr.String(),
+			i.masked(stdErr.String()),
 			i.Step.Name)
 	}
 
@@ -225,8 +782,39 @@ func (i *BuildStepInstance) Run() error {
 		return i.fail(cmdErr)
 	}
 
+	if traceFile != "" {
+		if err := i.reportTrace(traceFile, inputs); err != nil {
+			return i.fail(err)
+		}
+	}
+
+	// Nothing to check for a phony step
+	if i.Step.Phony {
+		return i.succeed()
+	}
+
+	// Find what the command produced for output globs and directories
+	if err := i.discoverOutputs(); err != nil {
+		return i.fail(err)
+	}
+	outputs := i.knownOutputs()
+
+	// Remember the directory input hashes we just built with
+	if td, ok := i.decider.(TimeDecider); ok && td.HashDirs {
+		hashes, err := td.CurrentHashes(inputs)
+		if err != nil {
+			return i.fail(err)
+		}
+		i.state.SetDirHashes(i.Step.Name, hashes)
+		td.DirHashes = hashes
+		i.decider = td
+	}
+
+	// Remember the environment we just built with
+	i.state.SetFingerprint(i.Step.Name, fingerprint)
+
 	// If we still need a build, then we failed
-	stillNeedBuild, err := i.decider.NeedBuild(i.Step.Inputs, i.Step.Outputs)
+	stillNeedBuild, err := i.decider.NeedBuild(inputs, outputs)
 	if err != nil {
 		return i.fail(fmt.Errorf("Build decider check failed AFTER build: %s", err.Error()))
 	}
@@ -235,7 +823,7 @@ func (i *BuildStepInstance) Run() error {
 	}
 
 	// if any outputs missing return failed
-	for _, file := range i.Step.Outputs {
+	for _, file := range outputs {
 		if _, err := os.Stat(file); os.IsNotExist(err) {
 			return i.fail(err)
 		}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -55,3 +63,970 @@ func TestSlowBuild(t *testing.T) {
 	assert.NoError(err)
 	assert.True(missing)
 }
+
+// chdirTemp changes to a new temporary directory and returns a function
+// that changes back and removes it
+func chdirTemp(assert *assert.Assertions) func() {
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	prevDir, err := os.Getwd()
+	pcheck(err)
+	pcheck(os.Chdir(dir))
+
+	return func() {
+		assert.NoError(os.Chdir(prevDir))
+		assert.NoError(os.RemoveAll(dir))
+	}
+}
+
+func TestNoStateFileBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	defer chdirTemp(assert)()
+
+	// Nothing to remember means no state file, even after running
+	cfg, err := ReadConfig([]byte(`
+first:
+    command: "touch a.txt"
+    outputs: [a.txt]
+second:
+    command: "cat a.txt > b.txt"
+    inputs: [a.txt]
+    outputs: [b.txt]
+`))
+	pcheck(err)
+	verb := log.New(ioutil.Discard, "", 0)
+	assert.Equal(0, DoBuild(cfg, verb))
+	assert.Equal(0, DoBuild(cfg, verb))
+	_, err = os.Stat("b.txt")
+	assert.NoError(err)
+	_, err = os.Stat(StateFileName)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestDependencyLoopBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	defer chdirTemp(assert)()
+
+	logged := &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	// The glob matches the output of the step depending on gather
+	cfg, err := ReadConfig([]byte(`
+gather:
+    command: "cat *.txt > report.txt"
+    inputs: ["*.txt"]
+    outputs: [report.txt]
+final:
+    command: "cp report.txt final.txt"
+    inputs: [report.txt]
+    outputs: [final.txt]
+`))
+	pcheck(err)
+	pcheck(ioutil.WriteFile("a.txt", []byte("a\n"), 0644))
+
+	assert.Equal(1, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+	assert.Contains(logged.String(), "Dependency loop found in 2 steps: final, gather")
+	_, err = os.Stat("report.txt")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestOutputGlobs(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/outglob.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	cfg, err := ReadConfig(cfgText)
+	assert.NoError(err)
+	assert.Len(cfg, 4)
+
+	// Inputs naming an output glob are left for the build
+	assert.Equal([]string{"parts/part-*.txt"}, cfg["combine"].Inputs)
+
+	// Dependencies are found via the globs and directories
+	assertSteps(assert, cfg, []string{"combine"}, "combine", "shards")
+	assertSteps(assert, cfg, []string{"final"}, "combine", "final", "report", "shards")
+
+	verb := log.New(ioutil.Discard, "", 0)
+	all := []string{"parts/part-1.txt", "parts/part-3.txt", "combined.txt", "report/sub/done.txt", "final.txt"}
+
+	assert.Equal(0, DoBuild(cfg, verb))
+	missing, err := AnyMissing(all)
+	assert.NoError(err)
+	assert.False(missing)
+
+	state, err := LoadState(StateFileName)
+	assert.NoError(err)
+	files, found := state.Discovered("shards", "parts/part-*.txt")
+	assert.True(found)
+	assert.Equal([]string{"parts/part-1.txt", "parts/part-2.txt", "parts/part-3.txt"}, files)
+	files, found = state.Discovered("report", "report/")
+	assert.True(found)
+	assert.Equal([]string{"report/combined.txt", "report/sub/done.txt"}, files)
+
+	// Nothing to do the second time
+	before, err := os.Stat("combined.txt")
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, verb))
+	after, err := os.Stat("combined.txt")
+	pcheck(err)
+	assert.Equal(before.ModTime(), after.ModTime())
+
+	// A missing shard means a rebuild
+	pcheck(os.Remove("parts/part-2.txt"))
+	assert.Equal(0, DoBuild(cfg, verb))
+	missing, err = AnyMissing([]string{"parts/part-2.txt"})
+	assert.NoError(err)
+	assert.False(missing)
+
+	// Clean gets everything, including the state
+	assert.Equal(0, DoClean(cfg, verb))
+	missing, err = AnyMissing([]string{"parts/part-1.txt"})
+	assert.NoError(err)
+	assert.True(missing)
+	missing, err = AnyMissing([]string{"report"})
+	assert.NoError(err)
+	assert.True(missing)
+	missing, err = AnyMissing([]string{StateFileName})
+	assert.NoError(err)
+	assert.True(missing)
+
+	// An output glob that matches nothing fails the step
+	cfg, err = ReadConfig([]byte("nothing: {command: 'true', outputs: ['none-*.txt']}"))
+	assert.NoError(err)
+	assert.Equal(1, DoBuild(cfg, verb))
+}
+
+func TestDeferredGlobs(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/globbing.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	// Nothing exists yet, but we still know the dependency
+	cfg, err := ReadConfig(cfgText)
+	assert.NoError(err)
+	assert.Equal([]string{"*.txt"}, cfg["globbed"].Inputs)
+	assertSteps(assert, cfg, []string{"globbed"}, "globbed", "multigen")
+
+	verb := log.New(ioutil.Discard, "", 0)
+	outputs := map[string]bool{"a.txt": true, "b.txt": true, "c.txt": true, "final.output": true}
+	inst := NewBuildStepInst(cfg["globbed"], outputs, verb, NewBroadcaster(), NewBuildState(StateFileName))
+	assert.Equal([]string{"a.txt", "b.txt", "c.txt"}, inst.Deps)
+
+	// The glob sees the files created by the upstream step
+	assert.Equal(0, DoBuild(cfg, verb))
+	missing, err := AnyMissing([]string{"a.txt", "b.txt", "c.txt", "final.output"})
+	assert.NoError(err)
+	assert.False(missing)
+
+	// And a newer matching file means a rebuild
+	earlier := time.Now().Add(-time.Hour)
+	for _, f := range []string{"a.txt", "b.txt", "c.txt", "final.output"} {
+		pcheck(os.Chtimes(f, earlier, earlier))
+	}
+	before, err := os.Stat("final.output")
+	pcheck(err)
+	pcheck(ioutil.WriteFile("new.txt", []byte("new"), 0644))
+	assert.Equal(0, DoBuild(cfg, verb))
+	after, err := os.Stat("final.output")
+	pcheck(err)
+	assert.True(after.ModTime().After(before.ModTime()))
+}
+
+func TestStepDepsBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/ordering.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	readLog := func() string {
+		b, err := ioutil.ReadFile("order.log")
+		pcheck(err)
+		pcheck(os.Remove("order.log"))
+		return string(b)
+	}
+	build := func(names ...string) {
+		cfg, err := ReadConfig(cfgText)
+		pcheck(err)
+		cfg, err = TrimSteps(cfg, names)
+		pcheck(err)
+		assert.Equal(0, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+	}
+
+	// Everything runs in order the first time
+	build("load")
+	assert.Equal("setup\nload\n", readLog())
+	build("migrate")
+	assert.Equal("schema\nmigrate\n", readLog())
+
+	// The phony step always runs, but load only runs after it
+	build("load")
+	assert.Equal("setup\n", readLog())
+
+	// Running a needed step means we run too
+	pcheck(os.Remove("schema.txt"))
+	build("migrate")
+	assert.Equal("schema\nmigrate\n", readLog())
+
+	build("everything")
+	assert.Contains(readLog(), "setup\n")
+}
+
+func TestForcedSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/select.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	verb := log.New(ioutil.Discard, "", 0)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, verb))
+
+	all := []string{"raw.csv", "features.csv", "a.model", "b.model", "report.html", "docs.html"}
+	earlier := time.Now().Add(-time.Hour)
+	for _, f := range all {
+		pcheck(os.Chtimes(f, earlier, earlier))
+	}
+
+	// Everything is up to date, but train_b and report are forced
+	cfg, err = ReadConfig(cfgText)
+	pcheck(err)
+	_, err = ForceSteps(cfg, []string{"train_b"})
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, verb))
+
+	for _, f := range all {
+		info, err := os.Stat(f)
+		pcheck(err)
+		rebuilt := f == "b.model" || f == "report.html"
+		assert.Equal(rebuilt, info.ModTime().After(earlier), f)
+	}
+}
+
+func TestAlwaysSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	defer chdirTemp(assert)()
+
+	cfgText := []byte(`
+fetch:
+    command: "echo fetched >> fetch.log && touch api.json"
+    outputs: [api.json]
+    always: true
+local:
+    command: "echo local >> local.log && touch local.txt"
+    outputs: [local.txt]
+broken:
+    command: "echo nothing"
+    outputs: [broken.txt]
+    explicit: true
+`)
+	verb := log.New(ioutil.Discard, "", 0)
+	build := func(always bool, names ...string) int {
+		cfg, err := ReadConfig(cfgText)
+		pcheck(err)
+		if len(names) > 0 {
+			cfg, err = TrimSteps(cfg, names)
+		} else {
+			cfg, err = NoExplicit(cfg)
+		}
+		pcheck(err)
+		if always {
+			AlwaysRun(cfg)
+		}
+		return DoBuild(cfg, verb)
+	}
+	lines := func(file string) int {
+		b, err := ioutil.ReadFile(file)
+		pcheck(err)
+		return strings.Count(string(b), "\n")
+	}
+
+	assert.Equal(0, build(false))
+	assert.Equal(0, build(false))
+	assert.Equal(2, lines("fetch.log"))
+	assert.Equal(1, lines("local.log"))
+
+	// Everything runs for -B
+	assert.Equal(0, build(true))
+	assert.Equal(3, lines("fetch.log"))
+	assert.Equal(2, lines("local.log"))
+
+	// Outputs are still checked
+	assert.Equal(1, build(true, "broken"))
+}
+
+func TestTouch(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/select.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	verb := log.New(ioutil.Discard, "", 0)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	cfg, err = NoExplicit(cfg)
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, verb))
+
+	// "Restore" the files so that the newest are upstream
+	all := []string{"report.html", "docs.html", "a.model", "b.model", "features.csv", "raw.csv"}
+	modTimes := func() []time.Time {
+		times := make([]time.Time, 0, len(all))
+		for _, f := range all {
+			info, err := os.Stat(f)
+			pcheck(err)
+			times = append(times, info.ModTime())
+		}
+		return times
+	}
+	base := time.Now().Add(-time.Hour)
+	for i, f := range all {
+		when := base.Add(time.Duration(i) * time.Minute)
+		pcheck(os.Chtimes(f, when, when))
+	}
+	restored := modTimes()
+
+	// Nothing is touched if an output is missing
+	pcheck(os.Rename("docs.html", "docs.bak"))
+	assert.Equal(1, DoTouch(cfg, verb))
+	pcheck(os.Rename("docs.bak", "docs.html"))
+	assert.Equal(restored, modTimes())
+
+	// Now everything is current: a build changes nothing
+	assert.Equal(0, DoTouch(cfg, verb))
+	touched := modTimes()
+	assert.NotEqual(restored, touched)
+	assert.Equal(0, DoBuild(cfg, verb))
+	assert.Equal(touched, modTimes())
+}
+
+func TestExplainStep(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/select.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	verb := log.New(ioutil.Discard, "", 0)
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+
+	explain := func(name string) string {
+		buf := &bytes.Buffer{}
+		inst := NewBuildStepInst(cfg[name], nil, verb, nil, NewBuildState(StateFileName))
+		assert.NoError(inst.Explain(cfg, log.New(buf, "", 0)))
+		return buf.String()
+	}
+
+	text := explain("report")
+	assert.Contains(text, "COMMAND: touch report.html\n")
+	assert.Contains(text, "  a.model: MISSING (from train_a)\n")
+	assert.Contains(text, "  report.html: MISSING\n")
+	assert.Contains(text, "DECISION: error")
+	assert.Contains(text, "REASON: input a.model is missing\n")
+
+	cfg, err = NoExplicit(cfg)
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, verb))
+	assert.Contains(explain("report"), "DECISION: up to date\n")
+
+	later := time.Now().Add(time.Hour)
+	pcheck(os.Chtimes("b.model", later, later))
+	text = explain("report")
+	assert.Contains(text, "DECISION: run\n")
+	assert.Contains(text, "REASON: input b.model (")
+
+	cfg["report"].Force = true
+	assert.Contains(explain("report"), "DECISION: run (forced from the command line)\n")
+}
+
+func TestShells(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/shells.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+
+	expected := map[string]string{
+		"plain.txt":  "plain\n",
+		"python.txt": "2,4,6\n",
+		"listed.txt": "listed\n",
+		"direct.txt": "plain\n",
+	}
+	for file, content := range expected {
+		b, err := ioutil.ReadFile(file)
+		assert.NoError(err)
+		assert.Equal(content, string(b), file)
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/execform.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+
+	missing, err := AnyMissing([]string{"a file.txt", "b;touch oops.txt", "my archive.tar"})
+	assert.NoError(err)
+	assert.False(missing)
+
+	// Nothing was run by a shell
+	missing, err = AnyMissing([]string{"oops.txt"})
+	assert.NoError(err)
+	assert.True(missing)
+}
+
+func TestWorkdir(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/workdir.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+
+	read := func(file string) string {
+		b, err := ioutil.ReadFile(file)
+		assert.NoError(err)
+		return strings.TrimSpace(string(b))
+	}
+	assert.Equal("tool", filepath.Base(read("where.txt")))
+	assert.Equal("data", read("result.txt"))
+	assert.Equal("../input.txt", read("tool/inputs.txt"))
+	assert.Equal("data", read("copy.txt"))
+
+	// A missing working directory is an error
+	pcheck(os.RemoveAll("tool"))
+	pcheck(os.Remove("copy.txt"))
+	cfg, err = SelectSteps(cfg, StepSelector{Names: []string{"listed"}, NoDeps: true})
+	pcheck(err)
+	assert.Equal(1, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+}
+
+func TestStepEnvironmentBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/stepenv.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	pcheck(os.Setenv("DMK_TEST_HIDDEN", "hidden"))
+	defer os.Unsetenv("DMK_TEST_HIDDEN")
+
+	pcheck(ioutil.WriteFile("step.env", []byte("TOKEN=one\n"), 0644))
+
+	// Returns true if the step ran
+	build := func(overrides map[string]string) bool {
+		cfg, err := ReadConfigVars(cfgText, overrides)
+		pcheck(err)
+		earlier := time.Now().Add(-time.Hour)
+		if _, err := os.Stat("env.txt"); err == nil {
+			pcheck(os.Chtimes("env.txt", earlier, earlier))
+		}
+		assert.Equal(0, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+		info, err := os.Stat("env.txt")
+		pcheck(err)
+		return info.ModTime().After(earlier)
+	}
+
+	assert.True(build(nil))
+	b, err := ioutil.ReadFile("env.txt")
+	pcheck(err)
+	text := string(b)
+	assert.Contains(text, "MODEL=xgb\n")
+	assert.Contains(text, "TOKEN=one\n")
+	assert.Contains(text, "DMK_STEPNAME=show\n")
+	assert.Contains(text, "PATH=")
+	assert.NotContains(text, "DMK_TEST_HIDDEN")
+
+	// Nothing changed
+	assert.False(build(nil))
+
+	// Env files and vars are tracked
+	pcheck(ioutil.WriteFile("step.env", []byte("TOKEN=two\n"), 0644))
+	assert.True(build(nil))
+	assert.False(build(nil))
+	assert.True(build(map[string]string{"MODEL": "rf"}))
+	assert.False(build(map[string]string{"MODEL": "rf"}))
+
+	// Without a record, the current values are just remembered
+	pcheck(os.Remove(StateFileName))
+	assert.False(build(nil))
+	assert.True(build(map[string]string{"MODEL": "rf"}))
+}
+
+func TestSecretsBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/secrets.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	logged := &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+	verb := log.New(logged, "", 0)
+
+	pcheck(ioutil.WriteFile("secret.env", []byte("API_TOKEN=token-5678\n"), 0644))
+
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Equal(0, DoBuild(cfg, verb))
+
+	b, err := ioutil.ReadFile("token.txt")
+	pcheck(err)
+	assert.Equal("token-5678\n", string(b))
+
+	text := logged.String()
+	assert.NotContains(text, "token-5678")
+	assert.NotContains(text, "key-1234")
+	assert.Contains(text, "key="+SecretMask)
+	assert.Contains(text, "var[MODEL]=='xgb'")
+	assert.Contains(text, "env API_TOKEN="+SecretMask)
+
+	// Nothing in the state can be matched to the value, but changes are
+	// still found
+	state, err := LoadState(StateFileName)
+	pcheck(err)
+	fp, found := state.Fingerprint("download")
+	assert.True(found)
+	assert.NotEqual(Fingerprint(map[string]string{"API_TOKEN": "token-5678"}, nil, "")["API_TOKEN"], fp["API_TOKEN"])
+	assert.Equal(Fingerprint(map[string]string{"MODEL": "xgb"}, nil, "")["MODEL"], fp["MODEL"])
+
+	buf := &bytes.Buffer{}
+	inst := NewBuildStepInst(cfg["download"], nil, verb, nil, state)
+	assert.NoError(inst.Explain(cfg, log.New(buf, "", 0)))
+	assert.Contains(buf.String(), "DECISION: up to date\n")
+	assert.Contains(buf.String(), "  cache/"+SecretMask+".txt: ")
+	assert.NotContains(buf.String(), "key-1234")
+
+	pcheck(ioutil.WriteFile("secret.env", []byte("API_TOKEN=token-0000\n"), 0644))
+	buf.Reset()
+	assert.NoError(inst.Explain(cfg, log.New(buf, "", 0)))
+	assert.Contains(buf.String(), "REASON: variable API_TOKEN changed\n")
+	assert.NotContains(buf.String(), "token-0000")
+}
+
+func TestTraceBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/trace.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	logged := &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	for _, f := range []string{"in.txt", "extra.txt", "unused.txt"} {
+		pcheck(ioutil.WriteFile(f, []byte(f+"\n"), 0644))
+	}
+
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.True(cfg["combine"].Trace)
+
+	if _, err := exec.LookPath(TraceProgram); err != nil {
+		assert.Equal(1, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+		assert.Contains(logged.String(), "Tracing requires "+TraceProgram)
+		return
+	}
+
+	assert.Equal(0, DoBuild(cfg, log.New(ioutil.Discard, "", 0)))
+	text := logged.String()
+	assert.Contains(text, "combine: TRACE read "+SecretMask+".txt, which is not an input\n")
+	assert.NotContains(text, "extra")
+	assert.Contains(text, "combine: TRACE never read input unused.txt\n")
+	assert.NotContains(text, "which is not an output")
+}
+
+// fakeRunner runs container specs locally, keeping every spec it runs
+type fakeRunner struct {
+	specs []ContainerSpec
+	lock  sync.Mutex
+}
+
+func (fr *fakeRunner) Run(spec ContainerSpec, stdout io.Writer, stderr io.Writer) error {
+	fr.lock.Lock()
+	fr.specs = append(fr.specs, spec)
+	fr.lock.Unlock()
+
+	cmd := exec.Command(spec.Argv[0], spec.Argv[1:]...)
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, spec.Env...) // The image's PATH
+	cmd.Dir = spec.Workdir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+func TestContainerBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := &fakeRunner{}
+	ContainerRunners["fake"] = runner
+	defer delete(ContainerRunners, "fake")
+
+	cfgText, err := ioutil.ReadFile("res/container.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+	root, err := os.Getwd()
+	pcheck(err)
+
+	pcheck(os.Setenv("HOST_ONLY_TEST", "host"))
+	defer os.Unsetenv("HOST_ONLY_TEST")
+	pcheck(ioutil.WriteFile("in.txt", []byte("input\n"), 0644))
+
+	all, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Equal("python:3.8", all["build"].Image)
+	cfg, err := NoExplicit(all)
+	pcheck(err)
+
+	verb := log.New(ioutil.Discard, "", 0)
+	assert.Equal(0, DoBuild(cfg, verb))
+	b, err := ioutil.ReadFile("model.txt")
+	pcheck(err)
+	assert.Equal("xgb\ninput\n", string(b))
+
+	assert.Len(runner.specs, 1)
+	spec := runner.specs[0]
+	assert.Equal("python:3.8", spec.Image)
+	assert.Equal(root, spec.Workdir)
+	assert.Equal([]Mount{{Path: root}}, spec.Mounts)
+	assert.Contains(spec.Env, "DMK_STEPNAME=build")
+	assert.Contains(spec.Env, "DMK_INPUTS=in.txt")
+	assert.Contains(spec.Env, "MODEL=xgb")
+	for _, kv := range spec.Env {
+		assert.NotContains(kv, "HOST_ONLY_TEST")
+	}
+
+	// Up to date, so nothing runs
+	assert.Equal(0, DoBuild(cfg, verb))
+	assert.Len(runner.specs, 1)
+
+	// Outputs are still checked
+	broken, err := TrimSteps(all, []string{"broken"})
+	pcheck(err)
+	assert.Equal(1, DoBuild(broken, verb))
+	assert.Len(runner.specs, 2)
+
+	_, err = ReadConfig([]byte("x:\n    command: x\n    image: alpine\n    runner: nope\n"))
+	assert.Error(err)
+}
+
+// fakeExecutor writes the job's command to each of the step's outputs instead
+// of running it, keeping every job it gets
+type fakeExecutor struct {
+	jobs []Job
+	fail bool
+	lock sync.Mutex
+}
+
+func (fe *fakeExecutor) Execute(job Job) error {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	fe.jobs = append(fe.jobs, job)
+	if fe.fail {
+		return errors.New("fake failure")
+	}
+	for _, out := range job.Step.Outputs {
+		if err := ioutil.WriteFile(out, []byte(job.Argv[len(job.Argv)-1]+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExecutorBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	exe := &fakeExecutor{}
+	Executors["fake"] = exe
+	defer delete(Executors, "fake")
+
+	cfgText, err := ioutil.ReadFile("res/executor.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+	assert.Equal("fake", cfg["remote"].ExecutorName())
+
+	verb := log.New(ioutil.Discard, "", 0)
+	assert.Equal(0, DoBuild(cfg, verb))
+	b, err := ioutil.ReadFile("local.txt")
+	pcheck(err)
+	assert.Equal("never run locally\n", string(b))
+
+	assert.Len(exe.jobs, 1)
+	job := exe.jobs[0]
+	assert.Equal("remote", job.Step.Name)
+	assert.Equal([]string{DefaultShell, "-c", "never run locally"}, job.Argv)
+	assert.Contains(job.Env, "DMK_OUTPUTS=remote.txt")
+	assert.Equal("xgb", job.Tracked["MODEL"])
+
+	// The decider is the same for every executor
+	assert.Equal(0, DoBuild(cfg, verb))
+	assert.Len(exe.jobs, 1)
+
+	// A failure is a failure no matter where the command ran
+	exe.fail = true
+	cfg["remote"].Force = true
+	assert.Equal(1, DoBuild(cfg, verb))
+	assert.Len(exe.jobs, 2)
+
+	_, err = ReadConfig([]byte("a:\n    command: x\n    executor: nope\n"))
+	assert.Error(err)
+}
+
+// Stand ins for ssh and scp: the "remote" host is just a local directory
+const fakeSSH = `#!/bin/bash
+# $1 is the host and $2 is the command
+echo "$1" >> "$FAKE_REMOTE_HOME/hosts.txt"
+echo "$2" >> "$FAKE_REMOTE_HOME/commands.txt"
+cd "$FAKE_REMOTE_HOME" && exec /bin/bash -c "$2"
+`
+
+const fakeSCP = `#!/bin/bash
+args=()
+for a in "$@"; do
+    case "$a" in
+        -r) args+=(-r) ;;
+        *:*) for f in $FAKE_REMOTE_HOME/${a#*:}; do args+=("$f"); done ;;
+        *) args+=("$a") ;;
+    esac
+done
+exec cp "${args[@]}"
+`
+
+func TestSSHBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/ssh.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	remoteHome, err := ioutil.TempDir("", "dmkremote")
+	pcheck(err)
+	defer os.RemoveAll(remoteHome)
+	pcheck(os.Setenv("FAKE_REMOTE_HOME", remoteHome))
+	defer os.Unsetenv("FAKE_REMOTE_HOME")
+
+	bin, err := ioutil.TempDir("", "dmkbin")
+	pcheck(err)
+	defer os.RemoveAll(bin)
+	pcheck(ioutil.WriteFile(filepath.Join(bin, "ssh"), []byte(fakeSSH), 0755))
+	pcheck(ioutil.WriteFile(filepath.Join(bin, "scp"), []byte(fakeSCP), 0755))
+	Executors["ssh-fake"] = SSHExecutor{SSH: filepath.Join(bin, "ssh"), SCP: filepath.Join(bin, "scp")}
+	defer delete(Executors, "ssh-fake")
+
+	pcheck(os.MkdirAll("data", 0755))
+	pcheck(ioutil.WriteFile("data/in.txt", []byte("input\n"), 0644))
+
+	cfg, err := ReadConfig(cfgText)
+	pcheck(err)
+
+	logged := &bytes.Buffer{}
+	verb := log.New(logged, "", 0)
+	assert.Equal(0, DoBuild(cfg, verb))
+
+	// Inputs went to the host, outputs came back
+	b, err := ioutil.ReadFile(filepath.Join(remoteHome, "work/pipe/data/in.txt"))
+	pcheck(err)
+	assert.Equal("input\n", string(b))
+	b, err = ioutil.ReadFile("report.txt")
+	pcheck(err)
+	assert.Equal("input\nxgb\n", string(b))
+	_, err = os.Stat("logs/run.log")
+	assert.NoError(err)
+	b, err = ioutil.ReadFile(filepath.Join(remoteHome, "hosts.txt"))
+	pcheck(err)
+	assert.Equal("worker\nworker\n", string(b)) // mkdir, then the command
+
+	// Secrets are set on the host without being on the ssh command line
+	b, err = ioutil.ReadFile("logs/run.log")
+	pcheck(err)
+	assert.Equal("token-5678\n", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(remoteHome, "commands.txt"))
+	pcheck(err)
+	assert.NotContains(string(b), "token-5678")
+	assert.NotContains(string(b), "xgb")
+
+	// Output from the host is logged
+	assert.Contains(logged.String(), "train stdout begin---\ntrained\n")
+
+	// Up to date locally means nothing runs on the host
+	assert.Equal(0, DoBuild(cfg, verb))
+	b, err = ioutil.ReadFile(filepath.Join(remoteHome, "hosts.txt"))
+	pcheck(err)
+	assert.Equal("worker\nworker\n", string(b))
+
+	// Missing outputs on the host are a failure
+	cfg["train"].Force = true
+	cfg["train"].Outputs = append(cfg["train"].Outputs, "never.txt")
+	assert.Equal(1, DoBuild(cfg, verb))
+}
+
+// Stand ins for sbatch and squeue: jobs run as soon as they are submitted,
+// and squeue reports the states listed in a file one at a time
+const fakeSbatch = `#!/bin/bash
+# The job script is last, after the options
+script="${@: -1}"
+out=$(sed -n 's/^#SBATCH --output=//p' "$script")
+err=$(sed -n 's/^#SBATCH --error=//p' "$script")
+cp "$script" "$FAKE_SLURM_DIR/last-job.sh"
+/bin/bash "$script" > "$out" 2> "$err"
+echo "42;cluster"
+`
+
+const fakeSqueue = `#!/bin/bash
+states="$FAKE_SLURM_DIR/states"
+if [ -s "$states" ]; then
+    state=$(head -n 1 "$states")
+    sed -i 1d "$states"
+    case "$state" in
+        PURGED) echo "slurm_load_jobs error: Invalid job id specified" 1>&2; exit 1 ;;
+        DOWN) echo "slurm_load_jobs error: Unable to contact slurm controller" 1>&2; exit 1 ;;
+        *) echo "$state" ;;
+    esac
+fi
+`
+
+func TestSlurmBuild(t *testing.T) {
+	assert := assert.New(t)
+
+	cfgText, err := ioutil.ReadFile("res/slurm.yaml")
+	pcheck(err)
+
+	defer chdirTemp(assert)()
+
+	slurmDir, err := ioutil.TempDir("", "dmkslurm")
+	pcheck(err)
+	defer os.RemoveAll(slurmDir)
+	pcheck(os.Setenv("FAKE_SLURM_DIR", slurmDir))
+	defer os.Unsetenv("FAKE_SLURM_DIR")
+	pcheck(ioutil.WriteFile(filepath.Join(slurmDir, "sbatch"), []byte(fakeSbatch), 0755))
+	pcheck(ioutil.WriteFile(filepath.Join(slurmDir, "squeue"), []byte(fakeSqueue), 0755))
+	Executors["slurm-fake"] = SlurmExecutor{
+		Sbatch: filepath.Join(slurmDir, "sbatch"),
+		Squeue: filepath.Join(slurmDir, "squeue"),
+		Poll:   time.Millisecond,
+	}
+	defer delete(Executors, "slurm-fake")
+	states := func(s string) {
+		pcheck(ioutil.WriteFile(filepath.Join(slurmDir, "states"), []byte(s), 0644))
+	}
+
+	all, err := ReadConfig(cfgText)
+	pcheck(err)
+	cfg, err := NoExplicit(all)
+	pcheck(err)
+
+	logged := &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+	verb := log.New(logged, "", 0)
+
+	states("PENDING\nRUNNING\nRUNNING\n")
+	assert.Equal(0, DoBuild(cfg, verb))
+	b, err := ioutil.ReadFile("model.txt")
+	pcheck(err)
+	assert.Equal("xgb\n", string(b))
+
+	text := logged.String()
+	assert.Contains(text, "train: submitted job 42\n")
+	assert.Contains(text, "train: job 42 is PENDING\n")
+	assert.Contains(text, "train: job 42 is RUNNING\n")
+	assert.Contains(text, "train stdout begin---\ntraining\n")
+	assert.Contains(text, "train stderr begin---\nwarning\n")
+
+	b, err = ioutil.ReadFile(filepath.Join(slurmDir, "last-job.sh"))
+	pcheck(err)
+	script := string(b)
+	assert.Contains(script, "#SBATCH --cpus-per-task=4\n")
+	assert.Contains(script, "#SBATCH --mem=8G\n")
+	assert.Contains(script, "#SBATCH --time=0:10:00\n")
+	assert.Contains(script, "#SBATCH --partition=short\n")
+
+	// Secrets reach the job without being written to the script
+	b, err = ioutil.ReadFile("token.txt")
+	pcheck(err)
+	assert.Equal("token-5678\n", string(b))
+	assert.NotContains(script, "token-5678")
+	info, err := os.Stat(filepath.Join(SlurmJobDir, "train", "job.sh"))
+	pcheck(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// Nothing submitted when up to date
+	logged.Reset()
+	assert.Equal(0, DoBuild(cfg, verb))
+	assert.NotContains(logged.String(), "submitted")
+
+	// The exit code is collected
+	broken, err := TrimSteps(all, []string{"broken"})
+	pcheck(err)
+	logged.Reset()
+	assert.Equal(1, DoBuild(broken, verb))
+	assert.Contains(logged.String(), "Job 42 exited with 3")
+
+	// A job that fails in the queue fails the step
+	cfg["train"].Force = true
+	states("PENDING\nCANCELLED by 1000\n")
+	logged.Reset()
+	assert.Equal(1, DoBuild(cfg, verb))
+	assert.Contains(logged.String(), "Job 42 is CANCELLED by 1000")
+
+	// A job purged from the queue before we see it finish is done, and the
+	// exit code decides how it went
+	states("RUNNING\nPURGED\n")
+	logged.Reset()
+	assert.Equal(0, DoBuild(cfg, verb))
+	assert.Contains(logged.String(), "train: Complete\n")
+	logged.Reset()
+	states("PURGED\n")
+	assert.Equal(1, DoBuild(broken, verb))
+	assert.Contains(logged.String(), "Job 42 exited with 3")
+
+	// Other squeue errors still fail the step
+	states("DOWN\n")
+	logged.Reset()
+	assert.Equal(1, DoBuild(cfg, verb))
+	assert.Contains(logged.String(), "Unable to contact slurm controller")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TraceProgram is used to trace the files a step's command opens
+const TraceProgram = "strace"
+
+// traceCalls are the system calls we trace: enough to see every file opened,
+// created, renamed, or executed
+const traceCalls = "open,openat,creat,rename,renameat,renameat2,execve"
+
+// TraceArgv returns the command line that runs argv under strace, following
+// child processes and writing the trace to logFile
+func TraceArgv(argv []string, logFile string) []string {
+	traced := []string{TraceProgram, "-f", "-qq", "-e", "trace=" + traceCalls, "-o", logFile, "--"}
+	return append(traced, argv...)
+}
+
+// FileAccess is the files a traced command read and wrote. Paths are
+// absolute.
+type FileAccess struct {
+	Read    map[string]bool
+	Written map[string]bool
+}
+
+var (
+	// An optional pid, then name(args) = result
+	traceCallRE = regexp.MustCompile(`^(?:\[?(?:pid\s+)?\d+\]?\s+)?(\w+)\((.*)\)\s+=\s+(-?\d+|\?)`)
+	// The start of a call interrupted by another process
+	traceUnfinishedRE = regexp.MustCompile(`^(?:\[?(?:pid\s+)?(\d+)\]?\s+)?(.*)\s+<unfinished \.\.\.>$`)
+	// The rest of an interrupted call
+	traceResumedRE = regexp.MustCompile(`^(?:\[?(?:pid\s+)?(\d+)\]?\s+)?<\.\.\. \w+ resumed>(.*)$`)
+	// Quoted strings in the args
+	traceStringRE = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+)
+
+// ParseTrace reads strace output and returns the files accessed. Relative
+// paths are relative to dir (where the command ran). Failed calls, and
+// opening directories, are ignored.
+func ParseTrace(r io.Reader, dir string) (FileAccess, error) {
+	access := FileAccess{
+		Read:    make(map[string]bool),
+		Written: make(map[string]bool),
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return access, err
+	}
+
+	abs := func(quoted string) (string, error) {
+		path, err := strconv.Unquote(`"` + quoted + `"`)
+		if err != nil {
+			return "", fmt.Errorf("Bad path in trace %q: %v", quoted, err)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(absDir, path)
+		}
+		return filepath.Clean(path), nil
+	}
+
+	unfinished := make(map[string]string) // pid to the start of the call
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := traceUnfinishedRE.FindStringSubmatch(line); m != nil {
+			unfinished[m[1]] = m[2]
+			continue
+		}
+		if m := traceResumedRE.FindStringSubmatch(line); m != nil {
+			start, ok := unfinished[m[1]]
+			if !ok {
+				continue
+			}
+			delete(unfinished, m[1])
+			line = start + m[2]
+		}
+
+		m := traceCallRE.FindStringSubmatch(line)
+		if m == nil || strings.HasPrefix(m[3], "-") || m[3] == "?" {
+			continue // Not a call, or it failed
+		}
+		call, args := m[1], m[2]
+		quoted := traceStringRE.FindAllStringSubmatch(args, -1)
+		if len(quoted) < 1 {
+			continue
+		}
+		first, err := abs(quoted[0][1])
+		if err != nil {
+			return access, err
+		}
+
+		switch call {
+		case "open", "openat":
+			if strings.Contains(args, "O_DIRECTORY") {
+				continue
+			}
+			if strings.Contains(args, "O_WRONLY") || strings.Contains(args, "O_RDWR") ||
+				strings.Contains(args, "O_CREAT") || strings.Contains(args, "O_TRUNC") {
+				access.Written[first] = true
+			} else {
+				access.Read[first] = true
+			}
+		case "creat":
+			access.Written[first] = true
+		case "execve":
+			access.Read[first] = true
+		case "rename", "renameat", "renameat2":
+			if len(quoted) < 2 {
+				continue
+			}
+			second, err := abs(quoted[1][1])
+			if err != nil {
+				return access, err
+			}
+			delete(access.Written, first)
+			access.Written[second] = true
+		}
+	}
+	return access, scanner.Err()
+}
+
+// TraceReport is the difference between what a step declares and what its
+// command actually did. File names are relative to the pipeline directory.
+type TraceReport struct {
+	UndeclaredInputs  []string // Read but not an input
+	UndeclaredOutputs []string // Written but not an output (or clean file)
+	UnreadInputs      []string // An input that was never read
+}
+
+// IsEmpty returns true if the step declares exactly what the command did
+func (tr TraceReport) IsEmpty() bool {
+	return len(tr.UndeclaredInputs)+len(tr.UndeclaredOutputs)+len(tr.UnreadInputs) < 1
+}
+
+// covers returns true if the file is declared by the pattern: the same file,
+// a glob match, or inside a directory
+func covers(pattern string, file string) bool {
+	if Produces(pattern, file) {
+		return true
+	}
+	dir := filepath.Clean(pattern)
+	if !strings.HasPrefix(file, dir+string(filepath.Separator)) {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// coveredBy returns true if any of the patterns covers the file
+func coveredBy(patterns []string, file string) bool {
+	for _, p := range patterns {
+		if covers(p, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTrace compares the files the step's command accessed with what the
+// step declares. inputs are the step's inputs after globbing. Only files in
+// the pipeline directory (the current directory) are checked, so things
+// like system libraries are ignored.
+func CheckTrace(step *BuildStep, inputs []string, access FileAccess) (TraceReport, error) {
+	report := TraceReport{}
+	root, err := os.Getwd()
+	if err != nil {
+		return report, err
+	}
+
+	// Returns the path relative to the pipeline directory, or false if the
+	// file isn't a file in the pipeline directory
+	local := func(path string) (string, bool) {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", false
+		}
+		if rel == StateFileName || rel == SaltFileName {
+			return "", false
+		}
+		info, err := os.Stat(rel)
+		if err != nil || info.IsDir() {
+			return "", false // Temporary files, directories, etc
+		}
+		return rel, true
+	}
+
+	read := make(map[string]bool)
+	for path := range access.Read {
+		rel, ok := local(path)
+		if !ok {
+			continue
+		}
+		read[rel] = true
+		if access.Written[path] {
+			continue // Something the command wrote itself
+		}
+		if !coveredBy(step.Inputs, rel) && !coveredBy(inputs, rel) {
+			report.UndeclaredInputs = append(report.UndeclaredInputs, rel)
+		}
+	}
+
+	declaredOutputs := append(append([]string{}, step.Outputs...), step.Clean...)
+	for path := range access.Written {
+		rel, ok := local(path)
+		if ok && !coveredBy(declaredOutputs, rel) {
+			report.UndeclaredOutputs = append(report.UndeclaredOutputs, rel)
+		}
+	}
+
+	for _, in := range inputs {
+		used := false
+		for file := range read {
+			if covers(in, file) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			report.UnreadInputs = append(report.UnreadInputs, in)
+		}
+	}
+
+	sort.Strings(report.UndeclaredInputs)
+	sort.Strings(report.UndeclaredOutputs)
+	sort.Strings(report.UnreadInputs)
+	return report, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Trimmed down output from strace -f -qq for a small bash command
+const sampleTrace = `101 execve("/bin/bash", ["/bin/bash", "-c", "python3 train.py"], 0x7ffc /* 20 vars */) = 0
+101 openat(AT_FDCWD, "/etc/ld.so.cache", O_RDONLY|O_CLOEXEC) = 3
+101 execve("/usr/local/bin/python3", ["python3", "train.py"], 0x55d1 /* 20 vars */) = -1 ENOENT (No such file or directory)
+101 execve("/usr/bin/python3", ["python3", "train.py"], 0x55d1 /* 20 vars */) = 0
+101 openat(AT_FDCWD, "train.py", O_RDONLY|O_CLOEXEC) = 3
+101 openat(AT_FDCWD, "data", O_RDONLY|O_NONBLOCK|O_CLOEXEC|O_DIRECTORY) = 3
+101 openat(AT_FDCWD, "data/a b.csv", O_RDONLY|O_CLOEXEC <unfinished ...>
+102 openat(AT_FDCWD, "settings.ini", O_RDONLY) = 4
+101 <... openat resumed>) = 5
+102 openat(AT_FDCWD, "missing.txt", O_RDONLY) = -1 ENOENT (No such file or directory)
+102 openat(AT_FDCWD, "model.tmp", O_WRONLY|O_CREAT|O_TRUNC|O_CLOEXEC, 0666) = 3
+102 rename("model.tmp", "model.pkl") = 0
+102 creat("/tmp/scratch", 0644) = 6
+102 open("log.txt", O_WRONLY|O_APPEND) = 7
+102 openat(AT_FDCWD, "tab\there", O_RDONLY) = 8
+102 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED} ---
+`
+
+func TestTraceArgv(t *testing.T) {
+	assert := assert.New(t)
+
+	argv := TraceArgv([]string{"/bin/bash", "-c", "make"}, "/tmp/trace")
+	assert.Equal(TraceProgram, argv[0])
+	assert.Contains(argv, "-f")
+	assert.Equal([]string{"-o", "/tmp/trace", "--", "/bin/bash", "-c", "make"}, argv[len(argv)-6:])
+}
+
+func TestParseTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	access, err := ParseTrace(strings.NewReader(sampleTrace), "/work")
+	assert.NoError(err)
+	assert.Equal(map[string]bool{
+		"/bin/bash":          true,
+		"/etc/ld.so.cache":   true,
+		"/usr/bin/python3":   true,
+		"/work/train.py":     true,
+		"/work/data/a b.csv": true,
+		"/work/settings.ini": true,
+		"/work/tab\there":    true,
+	}, access.Read)
+	assert.Equal(map[string]bool{
+		"/work/model.pkl": true,
+		"/tmp/scratch":    true,
+		"/work/log.txt":   true,
+	}, access.Written)
+
+	_, err = ParseTrace(strings.NewReader(`1 openat(AT_FDCWD, "bad\q", O_RDONLY) = 3`), "/work")
+	assert.Error(err)
+}
+
+func TestCheckTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+	prevDir, err := os.Getwd()
+	pcheck(err)
+	pcheck(os.Chdir(dir))
+	defer os.Chdir(prevDir)
+	root, err := os.Getwd()
+	pcheck(err)
+
+	pcheck(os.MkdirAll("data", 0755))
+	for _, f := range []string{"train.py", "unused.txt", "settings.ini", "data/a.csv", "model.pkl", "extra.log", StateFileName} {
+		pcheck(ioutil.WriteFile(f, []byte(f), 0644))
+	}
+
+	step := &BuildStep{
+		Name:    "train",
+		Inputs:  []string{"train.py", "unused.txt", "data"},
+		Outputs: []string{"model.pkl"},
+	}
+	at := func(files ...string) map[string]bool {
+		m := make(map[string]bool)
+		for _, f := range files {
+			m[filepath.Join(root, f)] = true
+		}
+		return m
+	}
+	access := FileAccess{
+		Read:    at("train.py", "settings.ini", "data/a.csv", StateFileName, "data", "gone.tmp"),
+		Written: at("model.pkl", "extra.log", "gone.tmp"),
+	}
+	access.Read["/etc/passwd"] = true
+
+	report, err := CheckTrace(step, step.Inputs, access)
+	assert.NoError(err)
+	assert.False(report.IsEmpty())
+	assert.Equal([]string{"settings.ini"}, report.UndeclaredInputs)
+	assert.Equal([]string{"extra.log"}, report.UndeclaredOutputs)
+	assert.Equal([]string{"unused.txt"}, report.UnreadInputs)
+
+	step.Inputs = []string{"*.py", "settings.ini", "data/"}
+	step.Clean = []string{"*.log"}
+	report, err = CheckTrace(step, []string{"train.py", "settings.ini", "data/a.csv"}, access)
+	assert.NoError(err)
+	assert.True(report.IsEmpty())
+}
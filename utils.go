@@ -1,6 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -44,74 +48,256 @@ func (u *UniqueStrings) Strings() []string {
 	return strings
 }
 
-// MaxTime returns the maximum mod time for the files
-func MaxTime(files []string) (time.Time, error) {
-	if len(files) < 1 {
-		return time.Time{}, nil
+// VarFlags collects KEY=VALUE pairs from a repeatable command line flag
+type VarFlags map[string]string
+
+// String returns the pairs in sorted order (for flag.Value)
+func (v VarFlags) String() string {
+	pairs := make([]string, 0, len(v))
+	for k, val := range v {
+		pairs = append(pairs, k+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// Set parses and adds a single KEY=VALUE pair (for flag.Value)
+func (v VarFlags) Set(s string) error {
+	eq := strings.Index(s, "=")
+	if eq < 1 {
+		return fmt.Errorf("variable must be KEY=VALUE: %s", s)
+	}
+	v[s[:eq]] = s[eq+1:]
+	return nil
+}
+
+// ListFlags collects the values from a repeatable command line flag
+type ListFlags []string
+
+// String returns the values in the order given (for flag.Value)
+func (l *ListFlags) String() string {
+	return strings.Join(*l, " ")
+}
+
+// Set adds a value (for flag.Value)
+func (l *ListFlags) Set(s string) error {
+	if len(strings.TrimSpace(s)) < 1 {
+		return fmt.Errorf("value may not be empty")
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// DirFilter selects the files used when a directory is walked. Patterns
+// are matched against both the file name and the path relative to the
+// directory. If Include is empty, every file is included. A directory
+// matching an Exclude pattern is skipped entirely.
+type DirFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// matchAny returns true if the name or relative path matches any pattern
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if m, err := filepath.Match(p, filepath.Base(rel)); err == nil && m {
+			return true
+		}
+		if m, err := filepath.Match(p, rel); err == nil && m {
+			return true
+		}
 	}
+	return false
+}
 
-	s, err := os.Stat(files[0])
+// Files returns the selected files under dir in sorted order
+func (f DirFilter) Files(dir string) ([]string, error) {
+	found := NewUniqueStrings()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil // The directory itself
+		}
+		if matchAny(f.Exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if len(f.Include) > 0 && !matchAny(f.Include, rel) {
+			return nil
+		}
+		found.Add(path)
+		return nil
+	})
 	if err != nil {
-		return time.Time{}, err
+		return []string{}, err
 	}
-	maxTime := s.ModTime()
+	return found.Strings(), nil
+}
 
-	for _, file := range files[1:] {
+// modTimes returns the mod times for the files: a directory is replaced by
+// the times of the selected files it contains (or its own time if there are
+// none). The file each time is for is also returned.
+func (f DirFilter) modTimes(files []string) ([]string, []time.Time, error) {
+	names := make([]string, 0, len(files))
+	times := make([]time.Time, 0, len(files))
+	for _, file := range files {
 		s, err := os.Stat(file)
 		if err != nil {
-			return time.Time{}, err
+			return nil, nil, err
+		}
+		if !s.IsDir() {
+			names = append(names, file)
+			times = append(times, s.ModTime())
+			continue
 		}
-		t := s.ModTime()
-		if t.After(maxTime) {
-			maxTime = t
+
+		contained, err := f.Files(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(contained) < 1 {
+			names = append(names, file)
+			times = append(times, s.ModTime())
+			continue
 		}
+		for _, c := range contained {
+			cs, err := os.Stat(c)
+			if err != nil {
+				return nil, nil, err
+			}
+			names = append(names, c)
+			times = append(times, cs.ModTime())
+		}
+	}
+	return names, times, nil
+}
+
+// Newest returns the file with the maximum mod time and that time, where a
+// directory is replaced by the selected files it contains
+func (f DirFilter) Newest(files []string) (string, time.Time, error) {
+	names, times, err := f.modTimes(files)
+	if err != nil || len(times) < 1 {
+		return "", time.Time{}, err
 	}
 
-	return maxTime, nil
+	idx := 0
+	for i, t := range times {
+		if t.After(times[idx]) {
+			idx = i
+		}
+	}
+	return names[idx], times[idx], nil
 }
 
-// MinTime returns minimum mod time for the files
-func MinTime(files []string) (time.Time, error) {
-	if len(files) < 1 {
-		return time.Time{}, nil
+// Oldest returns the file with the minimum mod time and that time, where a
+// directory is replaced by the selected files it contains
+func (f DirFilter) Oldest(files []string) (string, time.Time, error) {
+	names, times, err := f.modTimes(files)
+	if err != nil || len(times) < 1 {
+		return "", time.Time{}, err
 	}
 
-	s, err := os.Stat(files[0])
+	idx := 0
+	for i, t := range times {
+		if t.Before(times[idx]) {
+			idx = i
+		}
+	}
+	return names[idx], times[idx], nil
+}
+
+// MaxTime returns the maximum mod time for the files, where a directory's
+// time is the newest time of the selected files it contains
+func (f DirFilter) MaxTime(files []string) (time.Time, error) {
+	_, maxTime, err := f.Newest(files)
+	return maxTime, err
+}
+
+// MinTime returns the minimum mod time for the files, where a directory's
+// time is the oldest time of the selected files it contains
+func (f DirFilter) MinTime(files []string) (time.Time, error) {
+	_, minTime, err := f.Oldest(files)
+	return minTime, err
+}
+
+// Hash returns an aggregated content hash of the selected files under dir:
+// renaming, adding, removing, or changing any file changes the hash
+func (f DirFilter) Hash(dir string) (string, error) {
+	files, err := f.Files(dir)
 	if err != nil {
-		return time.Time{}, err
+		return "", err
 	}
-	minTime := s.ModTime()
 
-	for _, file := range files[1:] {
-		s, err := os.Stat(file)
+	total := sha256.New()
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
 		if err != nil {
-			return time.Time{}, err
+			return "", err
 		}
-		t := s.ModTime()
-		if t.Before(minTime) {
-			minTime = t
+		content, err := fileHash(file)
+		if err != nil {
+			return "", err
 		}
+		fmt.Fprintf(total, "%s\x00%s\n", filepath.ToSlash(rel), content)
 	}
+	return hex.EncodeToString(total.Sum(nil)), nil
+}
+
+// fileHash returns the hex SHA-256 hash of the file's contents
+func fileHash(file string) (string, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	return minTime, nil
+// MaxTime returns the maximum mod time for the files (see DirFilter.MaxTime)
+func MaxTime(files []string) (time.Time, error) {
+	return DirFilter{}.MaxTime(files)
+}
+
+// MinTime returns minimum mod time for the files (see DirFilter.MinTime)
+func MinTime(files []string) (time.Time, error) {
+	return DirFilter{}.MinTime(files)
 }
 
 // AnyMissing returns true if any file does not exist
 func AnyMissing(files []string) (bool, error) {
-	if len(files) < 1 {
-		return false, nil // no files - nothing can be missing
-	}
+	missing, err := FirstMissing(files)
+	return missing != "", err
+}
 
+// FirstMissing returns the first file that does not exist (or can't be
+// checked), or an empty string if they all exist
+func FirstMissing(files []string) (string, error) {
 	for _, file := range files {
 		if _, err := os.Stat(file); err != nil {
 			if os.IsNotExist(err) {
-				return true, nil
+				return file, nil
 			}
-			return true, err
+			return file, err
 		}
 	}
 
-	return false, nil
+	return "", nil
 }
 
 // FirstFileFound returns the first file that exists
@@ -135,7 +321,7 @@ func MultiGlob(patterns []string) ([]string, error) {
 		if len(strings.TrimSpace(p)) < 1 {
 			continue // no whitespace only (or empty) strings
 		}
-		if !strings.ContainsAny(p, "*?[]") {
+		if !IsGlob(p) {
 			found.Add(p) // Not a pattern
 			continue
 		}
@@ -150,3 +336,20 @@ func MultiGlob(patterns []string) ([]string, error) {
 
 	return found.Strings(), nil
 }
+
+// IsGlob returns true if the string appears to be a glob pattern
+func IsGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[]")
+}
+
+// IsDirPath returns true if the string names a directory by ending with a
+// path separator (like "parts/")
+func IsDirPath(s string) bool {
+	return strings.HasSuffix(s, "/") || strings.HasSuffix(s, string(os.PathSeparator))
+}
+
+// WalkFiles returns all files (but not directories) found under dir in
+// sorted order
+func WalkFiles(dir string) ([]string, error) {
+	return DirFilter{}.Files(dir)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -157,3 +158,166 @@ func TestMultiGlob(t *testing.T) {
 	assert.Equal([]string{}, found)
 	assert.Error(err)
 }
+
+func TestVarFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	v := VarFlags{}
+	assert.Equal("", v.String())
+
+	assert.NoError(v.Set("B=2"))
+	assert.NoError(v.Set("A=1"))
+	assert.NoError(v.Set("C="))
+	assert.NoError(v.Set("D=x=y"))
+	assert.Equal("A=1 B=2 C= D=x=y", v.String())
+
+	// Last one wins
+	assert.NoError(v.Set("A=one"))
+	assert.Equal("one", v["A"])
+
+	assert.Error(v.Set("novalue"))
+	assert.Error(v.Set("=nokey"))
+	assert.Len(v, 4)
+}
+
+func TestListFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	l := ListFlags{}
+	assert.Equal("", l.String())
+	assert.NoError(l.Set("b"))
+	assert.NoError(l.Set("a"))
+	assert.Equal("b a", l.String())
+	assert.Error(l.Set(" "))
+	assert.Equal(ListFlags{"b", "a"}, l)
+}
+
+func TestPathChecks(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(IsGlob("*.txt"))
+	assert.True(IsGlob("part-?.txt"))
+	assert.True(IsGlob("part-[0-9].txt"))
+	assert.False(IsGlob("part-0.txt"))
+	assert.False(IsGlob(""))
+
+	assert.True(IsDirPath("parts/"))
+	assert.True(IsDirPath("a/b/"))
+	assert.False(IsDirPath("parts"))
+	assert.False(IsDirPath(""))
+}
+
+func TestWalkFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+
+	found, err := WalkFiles(dir)
+	assert.NoError(err)
+	assert.Len(found, 0)
+
+	pcheck(os.MkdirAll(filepath.Join(dir, "sub", "deeper"), 0755))
+	for _, f := range []string{"b.txt", "a.txt", "sub/c.txt", "sub/deeper/d.txt"} {
+		pcheck(ioutil.WriteFile(filepath.Join(dir, f), []byte("yadda"), 0644))
+	}
+
+	found, err = WalkFiles(dir)
+	assert.NoError(err)
+	assert.Equal([]string{
+		filepath.Join(dir, "a.txt"),
+		filepath.Join(dir, "b.txt"),
+		filepath.Join(dir, "sub", "c.txt"),
+		filepath.Join(dir, "sub", "deeper", "d.txt"),
+	}, found)
+
+	_, err = WalkFiles(filepath.Join(dir, "not-here"))
+	assert.Error(err)
+}
+
+func TestDirFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dmktest")
+	pcheck(err)
+	defer os.RemoveAll(dir)
+
+	pcheck(os.MkdirAll(filepath.Join(dir, "pkg", "__pycache__"), 0755))
+	pcheck(os.MkdirAll(filepath.Join(dir, "empty"), 0755))
+	files := []string{"main.py", "notes.txt", "pkg/lib.py", "pkg/__pycache__/lib.pyc"}
+	for _, f := range files {
+		pcheck(ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644))
+	}
+	p := func(rel string) string {
+		return filepath.Join(dir, rel)
+	}
+
+	// Selecting files
+	found, err := DirFilter{}.Files(dir)
+	assert.NoError(err)
+	assert.Len(found, 4)
+
+	found, err = DirFilter{Include: []string{"*.py"}}.Files(dir)
+	assert.NoError(err)
+	assert.Equal([]string{p("main.py"), p("pkg/lib.py")}, found)
+
+	found, err = DirFilter{Exclude: []string{"__pycache__", "*.txt"}}.Files(dir)
+	assert.NoError(err)
+	assert.Equal([]string{p("main.py"), p("pkg/lib.py")}, found)
+
+	found, err = DirFilter{Include: []string{"pkg/*"}}.Files(dir)
+	assert.NoError(err)
+	assert.Equal([]string{p("pkg/lib.py")}, found)
+
+	// Times use the contained files
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	older := old.Add(-time.Hour)
+	for _, f := range files {
+		pcheck(os.Chtimes(p(f), older, older))
+	}
+	pcheck(os.Chtimes(p("pkg/lib.py"), old, old))
+
+	ti, err := MaxTime([]string{dir})
+	assert.NoError(err)
+	assert.Equal(old, ti)
+	ti, err = MinTime([]string{dir})
+	assert.NoError(err)
+	assert.Equal(older, ti)
+
+	// Excluded files don't count
+	pcheck(os.Chtimes(p("notes.txt"), time.Now(), time.Now()))
+	ti, err = DirFilter{Exclude: []string{"*.txt"}}.MaxTime([]string{dir})
+	assert.NoError(err)
+	assert.Equal(old, ti)
+
+	// An empty directory uses its own time
+	pcheck(os.Chtimes(p("empty"), older, older))
+	ti, err = MaxTime([]string{p("empty")})
+	assert.NoError(err)
+	assert.Equal(older, ti)
+
+	// Hashes only change with content or names
+	h1, err := DirFilter{}.Hash(dir)
+	assert.NoError(err)
+	pcheck(os.Chtimes(p("main.py"), time.Now(), time.Now()))
+	h2, err := DirFilter{}.Hash(dir)
+	assert.NoError(err)
+	assert.Equal(h1, h2)
+
+	pcheck(ioutil.WriteFile(p("pkg/__pycache__/lib.pyc"), []byte("changed"), 0644))
+	h3, err := DirFilter{}.Hash(dir)
+	assert.NoError(err)
+	assert.NotEqual(h1, h3)
+	h4, err := DirFilter{Exclude: []string{"__pycache__"}}.Hash(dir)
+	assert.NoError(err)
+	assert.NotEqual(h3, h4)
+
+	pcheck(os.Rename(p("notes.txt"), p("notes2.txt")))
+	h5, err := DirFilter{Exclude: []string{"__pycache__"}}.Hash(dir)
+	assert.NoError(err)
+	assert.NotEqual(h4, h5)
+
+	_, err = DirFilter{}.Hash(p("not-here"))
+	assert.Error(err)
+}